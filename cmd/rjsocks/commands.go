@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	rjsocks "github.com/tr3ee/go-rjsocks/core"
+)
+
+// eventResult is a state transition as printed by login and ctl events.
+type eventResult struct {
+	rjsocks.ControlEvent
+}
+
+func newEventResult(ev rjsocks.StateEvent) eventResult {
+	return eventResult{rjsocks.NewControlEvent(ev)}
+}
+
+func (r eventResult) text(w io.Writer) {
+	fmt.Fprintf(w, "%s %s -> %s", r.Time.Format(time.TimeOnly), r.From, r.To)
+	if len(r.Cause) > 0 {
+		fmt.Fprintf(w, " (%s)", r.Cause)
+	}
+	if len(r.Error) > 0 {
+		fmt.Fprintf(w, ": %s", r.Error)
+	}
+	fmt.Fprintln(w)
+}
+
+func (opts *options) parseDialect() (rjsocks.Dialect, error) {
+	d, err := rjsocks.ParseDialect(opts.dialect)
+	if err != nil {
+		return "", withCode(exitUsage, err)
+	}
+	return d, nil
+}
+
+// newService builds the service described by opts, logging in with pass.
+func (opts *options) newService(pass []byte) (*rjsocks.Service, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	srv, err := opts.sessionProfile().NewService(rjsocks.StaticPassword(pass))
+	if err != nil {
+		return nil, withCode(exitInterface, err)
+	}
+	return srv, nil
+}
+
+func runLogin(opts *options) error {
+	logger, closer, err := opts.logger()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	pass, err := opts.resolvePassword()
+	if err != nil {
+		return err
+	}
+	srv, err := opts.newService(pass)
+	clear(pass)
+	if err != nil {
+		return err
+	}
+	srv.SetLogger(logger)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	events, cancel := srv.Subscribe()
+	defer cancel()
+	printed := make(chan struct{})
+	go func() {
+		defer close(printed)
+		for ev := range events {
+			emit(opts, newEventResult(ev))
+		}
+	}()
+	err = srv.Run(ctx)
+	srv.Close()
+	<-printed
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// openHandle opens the interface without authenticating.
+func (opts *options) openHandle() (*rjsocks.Handle, error) {
+	if err := opts.needInterface(); err != nil {
+		return nil, err
+	}
+	dialect, err := opts.parseDialect()
+	if err != nil {
+		return nil, err
+	}
+	dev, err := rjsocks.SelectNetworkDev(opts.iface)
+	if err != nil {
+		return nil, withCode(exitInterface, err)
+	}
+	mac, err := rjsocks.SelectNetworkAdapter(opts.adapter)
+	if err != nil {
+		return nil, withCode(exitInterface, err)
+	}
+	h, err := rjsocks.NewHandle(dev, mac)
+	if err != nil {
+		return nil, withCode(exitInterface, err)
+	}
+	h.SetDialect(dialect)
+	return h, nil
+}
+
+type actionResult struct {
+	Interface string `json:"interface"`
+	Action    string `json:"action"`
+}
+
+func (r actionResult) text(w io.Writer) {
+	fmt.Fprintf(w, "%s sent on %s\n", r.Action, r.Interface)
+}
+
+func runLogoff(opts *options) error {
+	h, err := opts.openHandle()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	if err := h.SendLogoffPkt(); err != nil {
+		return withCode(exitInterface, err)
+	}
+	emit(opts, actionResult{Interface: opts.iface, Action: "logoff"})
+	return nil
+}
+
+type statusResult struct {
+	Interface string   `json:"interface"`
+	MAC       string   `json:"mac"`
+	Up        bool     `json:"up"`
+	IP        string   `json:"ip,omitempty"`
+	Mask      string   `json:"mask,omitempty"`
+	Gateway   string   `json:"gateway,omitempty"`
+	DNS       string   `json:"dns,omitempty"`
+	DHCP      bool     `json:"dhcp"`
+	IPv6      []string `json:"ipv6,omitempty"`
+	// Session is what a daemon on this machine reported last.
+	Session *rjsocks.Status `json:"session,omitempty"`
+}
+
+func (r statusResult) text(w io.Writer) {
+	state := "down"
+	if r.Up {
+		state = "up"
+	}
+	fmt.Fprintf(w, "interface: %s (%s, %s)\n", r.Interface, r.MAC, state)
+	fmt.Fprintf(w, "ipv4:      %s mask %s gateway %s dns %s dhcp %v\n", r.IP, r.Mask, r.Gateway, r.DNS, r.DHCP)
+	if len(r.IPv6) > 0 {
+		fmt.Fprintf(w, "ipv6:      %s\n", strings.Join(r.IPv6, " "))
+	}
+	if r.Session != nil {
+		fmt.Fprint(w, "session:   ")
+		sessionText(w, r.Session)
+	}
+}
+
+func sessionText(w io.Writer, st *rjsocks.Status) {
+	fmt.Fprintf(w, "%s as %s since %s", st.State, st.User, st.Since.Format(time.DateTime))
+	if len(st.Authenticator) > 0 {
+		fmt.Fprintf(w, ", authenticator %s", st.Authenticator)
+	}
+	if len(st.Error) > 0 {
+		fmt.Fprintf(w, ", %s", st.Error)
+	}
+	fmt.Fprintln(w)
+}
+
+func runStatus(opts *options) error {
+	session := readStatus(opts.runDir)
+	if len(opts.iface) == 0 && session != nil {
+		opts.iface, opts.adapter = session.Device, session.Adapter
+	}
+	if err := opts.needInterface(); err != nil {
+		return err
+	}
+	ifc, err := net.InterfaceByName(opts.adapter)
+	if err != nil {
+		return withCode(exitInterface, err)
+	}
+	res := statusResult{Interface: ifc.Name, MAC: ifc.HardwareAddr.String(), Up: ifc.Flags&net.FlagUp != 0}
+	if session != nil && session.Adapter == ifc.Name {
+		res.Session = session
+	}
+	if info, err := rjsocks.LookupIPInfo(ifc.Name); info != nil {
+		res.DHCP = info.DHCP
+		if info.IP != nil {
+			res.IP = info.IP.String()
+			res.Mask = net.IP(info.Mask).String()
+		}
+		if info.Gateway != nil {
+			res.Gateway = info.Gateway.String()
+		}
+		if info.DNS != nil {
+			res.DNS = info.DNS.String()
+		}
+	} else if err != nil {
+		return withCode(exitInterface, err)
+	}
+	if info, err := rjsocks.LookupIPv6Info(ifc.Name); err == nil {
+		for _, ip := range append([]net.IP{info.LinkLocal, info.Temporary}, info.Global...) {
+			if ip != nil {
+				res.IPv6 = append(res.IPv6, ip.String())
+			}
+		}
+	}
+	emit(opts, res)
+	return nil
+}
+
+type adapterResult struct {
+	Name  string   `json:"name"`
+	MAC   string   `json:"mac"`
+	Up    bool     `json:"up"`
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+type interfacesResult struct {
+	Devices  []string        `json:"devices"`
+	Adapters []adapterResult `json:"adapters"`
+}
+
+func (r interfacesResult) text(w io.Writer) {
+	fmt.Fprintln(w, "devices:")
+	for _, dev := range r.Devices {
+		fmt.Fprintf(w, "  %s\n", dev)
+	}
+	fmt.Fprintln(w, "adapters:")
+	for _, a := range r.Adapters {
+		state := "down"
+		if a.Up {
+			state = "up"
+		}
+		fmt.Fprintf(w, "  %-16s %-17s %-4s %s\n", a.Name, a.MAC, state, strings.Join(a.Addrs, " "))
+	}
+}
+
+func runListInterfaces(opts *options) error {
+	devs, err := rjsocks.ListNetworkDev()
+	if err != nil {
+		return withCode(exitInterface, err)
+	}
+	ifcs, err := net.Interfaces()
+	if err != nil {
+		return withCode(exitInterface, err)
+	}
+	res := interfacesResult{Devices: devs, Adapters: []adapterResult{}}
+	for _, ifc := range ifcs {
+		if ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		a := adapterResult{Name: ifc.Name, MAC: ifc.HardwareAddr.String(), Up: ifc.Flags&net.FlagUp != 0}
+		addrs, _ := ifc.Addrs()
+		for _, addr := range addrs {
+			a.Addrs = append(a.Addrs, addr.String())
+		}
+		res.Adapters = append(res.Adapters, a)
+	}
+	emit(opts, res)
+	return nil
+}
+
+type probeResult struct {
+	Interface     string  `json:"interface"`
+	Authenticator string  `json:"authenticator"`
+	Dialect       string  `json:"dialect"`
+	EapID         uint8   `json:"eap_id"`
+	RTT           float64 `json:"rtt_ms"`
+}
+
+func (r probeResult) text(w io.Writer) {
+	fmt.Fprintf(w, "authenticator %s answered on %s after %.1fms, dialect %s\n", r.Authenticator, r.Interface, r.RTT, r.Dialect)
+}
+
+func runProbe(opts *options) error {
+	h, err := opts.openHandle()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+	res, err := rjsocks.Probe(ctx, h)
+	if err != nil {
+		return err
+	}
+	emit(opts, probeResult{
+		Interface:     opts.iface,
+		Authenticator: res.Authenticator.String(),
+		Dialect:       string(res.Dialect),
+		EapID:         res.EapID,
+		RTT:           float64(res.RTT.Microseconds()) / 1000,
+	})
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	rjsocks "github.com/tr3ee/go-rjsocks/core"
+)
+
+const (
+	controlSocketName = "control.sock"
+	// controlTokenName holds the token of a TCP control endpoint, readable
+	// by the daemon's user only.
+	controlTokenName = "control.token"
+)
+
+// controlAddr returns the control endpoint, empty when it is disabled.
+func (opts *options) controlAddr() string {
+	switch opts.control {
+	case "":
+		return "unix:" + filepath.Join(opts.runDir, controlSocketName)
+	case "none":
+		return ""
+	}
+	return opts.control
+}
+
+// writeControlToken creates a fresh token for a TCP endpoint, unix sockets
+// are protected by their permissions and get none.
+func writeControlToken(opts *options) (string, error) {
+	if strings.HasPrefix(opts.controlAddr(), "unix:") {
+		return "", nil
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.WriteFile(filepath.Join(opts.runDir, controlTokenName), []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+type controlClient struct {
+	client *http.Client
+	base   string
+	token  string
+}
+
+func (opts *options) controlClient() (*controlClient, error) {
+	addr := opts.controlAddr()
+	if len(addr) == 0 {
+		return nil, withCode(exitUsage, fmt.Errorf("%w: the control endpoint is disabled", errUsage))
+	}
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		c := &controlClient{client: &http.Client{}, base: "http://" + addr}
+		if buf, err := os.ReadFile(filepath.Join(opts.runDir, controlTokenName)); err == nil {
+			c.token = strings.TrimSpace(string(buf))
+		}
+		return c, nil
+	}
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	return &controlClient{client: &http.Client{Transport: &http.Transport{DialContext: dial}}, base: "http://rjsocks"}, nil
+}
+
+// do sends a request to the daemon, the caller closes the body of a
+// successful response.
+func (c *controlClient) do(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("no daemon answering: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("%s: %s", resp.Status, e.Error)
+	}
+	return resp, nil
+}
+
+// sessionResult is the Status of a daemon as printed by ctl.
+type sessionResult struct {
+	rjsocks.Status
+}
+
+func (r sessionResult) text(w io.Writer) {
+	sessionText(w, &r.Status)
+}
+
+func runCtl(opts *options) error {
+	action := "status"
+	switch len(opts.rest) {
+	case 0:
+	case 1:
+		action = opts.rest[0]
+	default:
+		return withCode(exitUsage, fmt.Errorf("%w: ctl takes one action", errUsage))
+	}
+	c, err := opts.controlClient()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	method, path := http.MethodPost, "/v1/"+action
+	switch action {
+	case "events":
+		return ctlEvents(ctx, opts, c)
+	case "status":
+		method = http.MethodGet
+	case rjsocks.ControlStop, rjsocks.ControlContinue, rjsocks.ControlReauth, rjsocks.ControlLogoff, rjsocks.ControlReload:
+	default:
+		return withCode(exitUsage, fmt.Errorf("%w: unknown action %q", errUsage, action))
+	}
+	resp, err := c.do(ctx, method, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res sessionResult
+	if err := json.NewDecoder(resp.Body).Decode(&res.Status); err != nil {
+		return err
+	}
+	emit(opts, res)
+	return nil
+}
+
+// ctlEvents prints the daemon's transitions until it closes the session or
+// ctl is interrupted.
+func ctlEvents(ctx context.Context, opts *options, c *controlClient) error {
+	resp, err := c.do(ctx, http.MethodGet, "/v1/events")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev eventResult
+		if err := dec.Decode(&ev.ControlEvent); err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		emit(opts, ev)
+	}
+}
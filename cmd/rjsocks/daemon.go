@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	rjsocks "github.com/tr3ee/go-rjsocks/core"
+)
+
+const (
+	defaultRunDir  = "/run/rjsocks"
+	pidFileName    = "rjsocks.pid"
+	statusFileName = "status.json"
+	// statusInterval refreshes the status file between transitions.
+	statusInterval = 30 * time.Second
+)
+
+// daemon keeps one session up and reacts to signals, see runDaemon.
+type daemon struct {
+	opts     *options
+	pass     []byte
+	srv      *rjsocks.Service
+	logger   *slog.Logger
+	logClose io.Closer
+	notify   *notifier
+	ready    bool
+	control  *rjsocks.ControlServer
+	// reloads carries reload requests of the control endpoint into the
+	// session loop.
+	reloads chan chan error
+}
+
+// runDaemon logs in and stays in the foreground under a service manager.
+// SIGTERM and SIGINT log off, SIGHUP re-reads the configuration and only
+// restarts the session if the credentials, interface, dialect or multicast
+// address changed. The control endpoint offers the same and more to local
+// clients.
+func runDaemon(opts *options) error {
+	d := &daemon{opts: opts, notify: newNotifier(), reloads: make(chan chan error)}
+	defer d.notify.Close()
+	var err error
+	if d.logger, d.logClose, err = opts.logger(); err != nil {
+		return err
+	}
+	defer func() { d.logClose.Close() }()
+	if d.pass, err = opts.resolvePassword(); err != nil {
+		return err
+	}
+	defer func() { clear(d.pass) }()
+	if err := writePIDFile(opts.runDir); err != nil {
+		return err
+	}
+	defer os.Remove(filepath.Join(opts.runDir, pidFileName))
+	defer os.Remove(filepath.Join(opts.runDir, statusFileName))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopControl, err := d.serveControl(ctx)
+	if err != nil {
+		return err
+	}
+	defer stopControl()
+	defer os.Remove(filepath.Join(opts.runDir, controlTokenName))
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		restart, err := d.session(ctx, hup)
+		if !restart {
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// session runs one Service until it ends, ctx is cancelled or a reload asks
+// for a new session.
+func (d *daemon) session(ctx context.Context, hup <-chan os.Signal) (restart bool, err error) {
+	srv, err := d.opts.newService(d.pass)
+	if err != nil {
+		return false, err
+	}
+	d.srv = srv
+	srv.SetLogger(d.logger)
+	if d.control != nil {
+		d.control.SetService(srv)
+	}
+	events, cancel := srv.Subscribe()
+	defer cancel()
+	runCtx, stopRun := context.WithCancel(ctx)
+	defer stopRun()
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(runCtx) }()
+	defer srv.Close()
+
+	var watchdog <-chan time.Time
+	if interval := watchdogInterval(); interval > 0 {
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		watchdog = t.C
+	}
+	refresh := time.NewTicker(statusInterval)
+	defer refresh.Stop()
+	d.writeStatus()
+	for {
+		restart := false
+		select {
+		case err := <-done:
+			d.notify.notify("STOPPING=1", "STATUS=session ended")
+			return false, err
+		case <-ctx.Done():
+			d.notify.notify("STOPPING=1", "STATUS=logging off")
+			stopRun()
+			return false, <-done
+		case <-hup:
+			restart, _ = d.reload()
+		case reply := <-d.reloads:
+			var err error
+			restart, err = d.reload()
+			reply <- err
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			d.transition(ev)
+		case <-watchdog:
+			// a failed session stops feeding the watchdog so systemd
+			// restarts it
+			if srv.State() != rjsocks.SrvStatError {
+				d.notify.notify("WATCHDOG=1")
+			}
+		case <-refresh.C:
+			d.writeStatus()
+		}
+		if restart {
+			d.logger.Info("credentials changed, restarting the session")
+			stopRun()
+			<-done
+			return true, nil
+		}
+	}
+}
+
+// serveControl starts the control endpoint, the returned func stops it and
+// waits until its socket is gone.
+func (d *daemon) serveControl(ctx context.Context) (func(), error) {
+	addr := d.opts.controlAddr()
+	if len(addr) == 0 {
+		return func() {}, nil
+	}
+	ln, err := rjsocks.ListenControl(addr)
+	if err != nil {
+		return nil, withCode(exitUsage, err)
+	}
+	token, err := writeControlToken(d.opts)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	d.control = rjsocks.NewControlServer(nil, token)
+	d.control.Reload = func() error { return d.requestReload(ctx) }
+	ctx, cancel := context.WithCancel(ctx)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := d.control.Serve(ctx, ln); err != nil {
+			d.logger.Error("control endpoint failed", "addr", addr, "err", err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-served
+	}, nil
+}
+
+// requestReload reloads from the session loop like SIGHUP does.
+func (d *daemon) requestReload(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case d.reloads <- reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-reply
+}
+
+func (d *daemon) transition(ev rjsocks.StateEvent) {
+	state := []string{"STATUS=" + ev.To.Name()}
+	if ev.Err != nil {
+		state[0] += ": " + ev.Err.Error()
+	}
+	// ready once authenticated, a failing login still counts as started
+	if !d.ready && (ev.To.Online() || ev.To == rjsocks.SrvStatHeld) {
+		d.ready = true
+		state = append(state, "READY=1")
+	}
+	d.notify.notify(state...)
+	d.writeStatus()
+}
+
+// reload re-reads the configuration and applies what can change without a
+// new session. It reports whether the session has to be restarted.
+func (d *daemon) reload() (bool, error) {
+	d.notify.notify("RELOADING=1")
+	defer func() {
+		if d.ready {
+			d.notify.notify("READY=1")
+		}
+	}()
+	opts, err := parseOptions(d.opts.name, d.opts.args)
+	if err == nil {
+		err = opts.validate()
+	}
+	var pass []byte
+	if err == nil {
+		pass, err = d.reloadPassword(opts)
+	}
+	if err != nil {
+		d.logger.Error("reload failed, keeping the old configuration", "err", err)
+		return false, err
+	}
+	next, prev := opts.sessionProfile(), d.opts.sessionProfile()
+	restart := opts.user != d.opts.user || !bytes.Equal(pass, d.pass) ||
+		opts.iface != d.opts.iface || opts.adapter != d.opts.adapter || opts.dialect != d.opts.dialect ||
+		next.Multicast != prev.Multicast
+	if l, closer, err := opts.logger(); err == nil {
+		d.logClose.Close()
+		d.logger, d.logClose = l, closer
+		d.srv.SetLogger(l)
+	} else {
+		d.logger.Error("cannot open the new log sink", "err", err)
+	}
+	if !restart && opts.renew != d.opts.renew {
+		if r, err := rjsocks.NewRenewer(opts.renew); err == nil {
+			d.srv.SetRenewer(r)
+		} else if opts.renew == rjsocks.RenewDHCP {
+			err = d.srv.EnableDHCP(rjsocks.DefaultConfigurator())
+		}
+		if err != nil {
+			d.logger.Error("cannot switch the renew method", "renew", opts.renew, "err", err)
+		}
+	}
+	if !restart {
+		d.srv.SetBackoffPolicy(next.BackoffPolicy())
+		d.srv.SetHooks(next.Hooks)
+	}
+	clear(d.pass)
+	d.opts, d.pass = opts, pass
+	d.logger.Info("configuration reloaded", "restart", restart)
+	return restart, nil
+}
+
+// reloadPassword resolves the password of the new options. A password that
+// was typed or piped in cannot be asked for again, so it is kept as long as
+// its source is unchanged.
+func (d *daemon) reloadPassword(opts *options) ([]byte, error) {
+	switch opts.passwordFrom {
+	case "prompt", "stdin":
+		if opts.passwordFrom == d.opts.passwordFrom {
+			return bytes.Clone(d.pass), nil
+		}
+	}
+	return opts.resolvePassword()
+}
+
+// writeStatus replaces the status file atomically.
+func (d *daemon) writeStatus() {
+	buf, err := json.MarshalIndent(struct {
+		PID int `json:"pid"`
+		rjsocks.Status
+	}{os.Getpid(), d.srv.Status()}, "", "  ")
+	if err != nil {
+		return
+	}
+	path := filepath.Join(d.opts.runDir, statusFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(buf, '\n'), 0644); err != nil {
+		d.logger.Warn("cannot write status file", "err", err)
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+// writePIDFile refuses to start over a running daemon.
+func writePIDFile(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, pidFileName)
+	if buf, err := os.ReadFile(path); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(buf))); err == nil && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("already running as pid %d (%s)", pid, path)
+		}
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// readStatus returns the status file of a running daemon, nil if there is
+// none.
+func readStatus(dir string) *rjsocks.Status {
+	buf, err := os.ReadFile(filepath.Join(dir, statusFileName))
+	if err != nil {
+		return nil
+	}
+	st := new(rjsocks.Status)
+	if json.Unmarshal(buf, st) != nil {
+		return nil
+	}
+	return st
+}
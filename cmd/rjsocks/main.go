@@ -0,0 +1,148 @@
+// Command rjsocks is the headless client for Linux boxes and scripts.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	rjsocks "github.com/tr3ee/go-rjsocks/core"
+)
+
+// Exit codes are part of the interface, scripts rely on them.
+const (
+	exitOK              = 0
+	exitError           = 1
+	exitUsage           = 2
+	exitAuthFailed      = 3
+	exitNoAuthenticator = 4
+	exitInterface       = 5
+)
+
+type command struct {
+	usage string
+	run   func(opts *options) error
+	// args names the positional arguments, commands without take none.
+	args string
+}
+
+var commands = map[string]command{
+	"login":           {"authenticate and keep the session alive until interrupted", runLogin, ""},
+	"daemon":          {"like login, for systemd: sd_notify, pid and status files, SIGHUP reloads, control socket", runDaemon, ""},
+	"logoff":          {"send an EAPOL-Logoff on the interface", runLogoff, ""},
+	"status":          {"show the interface and the session of a running daemon", runStatus, ""},
+	"list-interfaces": {"list the devices and adapters that can be used", runListInterfaces, ""},
+	"probe":           {"look for an authenticator without logging in", runProbe, ""},
+	multiCommand:      {"run several profiles of a TOML config at once, each on its own interface or macvlan", runMulti, ""},
+	"ctl":             {"drive a running daemon: status, events, stop, continue, reauth, logoff, reload", runCtl, "[action]"},
+}
+
+// codedError carries the exit code of a failed command.
+type codedError struct {
+	code int
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+
+func (e *codedError) Unwrap() error { return e.err }
+
+func withCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+func exitCode(err error) int {
+	var ee *codedError
+	var fe *rjsocks.FailureError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &ee):
+		return ee.code
+	case errors.As(err, &fe):
+		return exitAuthFailed
+	case errors.Is(err, rjsocks.ErrNoAuthenticator):
+		return exitNoAuthenticator
+	}
+	return exitError
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: rjsocks <command> [flags] [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-16s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(w, "\nexit codes: %d ok, %d error, %d usage, %d authentication failed, %d no authenticator, %d interface error\n",
+		exitOK, exitError, exitUsage, exitAuthFailed, exitNoAuthenticator, exitInterface)
+	fmt.Fprintf(w, "run 'rjsocks <command> -h' for the flags of a command\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		usage(os.Stdout)
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "rjsocks: unknown command %q\n", name)
+		usage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+	opts, err := parseOptions(name, os.Args[2:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err == nil && len(opts.rest) > 0 && len(cmd.args) == 0 {
+		err = withCode(exitUsage, fmt.Errorf("%w: unexpected argument %q", errUsage, opts.rest[0]))
+	}
+	if err == nil {
+		err = cmd.run(opts)
+	}
+	if err != nil {
+		report(opts, err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// report prints err, as an object on stdout in JSON mode.
+func report(opts *options, err error) {
+	if opts != nil && opts.json {
+		json.NewEncoder(os.Stdout).Encode(struct {
+			Error string `json:"error"`
+			Code  int    `json:"code"`
+		}{err.Error(), exitCode(err)})
+		return
+	}
+	fmt.Fprintf(os.Stderr, "rjsocks: %v\n", err)
+}
+
+// texter is implemented by results that have a human readable form.
+type texter interface {
+	text(w io.Writer)
+}
+
+// emit prints a command result in the selected format.
+func emit(opts *options, v texter) {
+	if opts.json {
+		json.NewEncoder(os.Stdout).Encode(v)
+		return
+	}
+	v.text(os.Stdout)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	rjsocks "github.com/tr3ee/go-rjsocks/core"
+)
+
+const (
+	multiCommand     = "multi"
+	sessionsFileName = "sessions.json"
+	// sessionsInterval refreshes the sessions file, there is no single
+	// session whose transitions could trigger it.
+	sessionsInterval = 5 * time.Second
+)
+
+// runMulti runs several profiles of a TOML config side by side, all of them
+// unless -profile lists some, e.g. -profile rack1,rack2. Each session is
+// restarted on its own, their summary is kept in the sessions file of the
+// run dir.
+func runMulti(opts *options) error {
+	if opts.profiles == nil {
+		return withCode(exitUsage, fmt.Errorf("%w: %s needs a TOML config with profiles", errUsage, multiCommand))
+	}
+	names := opts.profiles.Names()
+	if len(opts.profileName) > 0 {
+		names = strings.Split(opts.profileName, ",")
+	}
+	logger, closer, err := opts.logger()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	m := rjsocks.NewManager()
+	m.SetLogger(logger)
+	for _, name := range names {
+		p, err := opts.profiles.Profile(strings.TrimSpace(name))
+		if err != nil {
+			return withCode(exitUsage, err)
+		}
+		if err := m.Add(p, nil); err != nil {
+			return withCode(exitUsage, fmt.Errorf("profile %s: %w", p.Name, err))
+		}
+	}
+	if err := writePIDFile(opts.runDir); err != nil {
+		return err
+	}
+	defer os.Remove(filepath.Join(opts.runDir, pidFileName))
+	defer os.Remove(filepath.Join(opts.runDir, sessionsFileName))
+
+	notify := newNotifier()
+	defer notify.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	done := make(chan error, 1)
+	go func() { done <- m.Run(ctx) }()
+	notify.notify("READY=1")
+
+	var watchdog <-chan time.Time
+	if interval := watchdogInterval(); interval > 0 {
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		watchdog = t.C
+	}
+	refresh := time.NewTicker(sessionsInterval)
+	defer refresh.Stop()
+	for {
+		select {
+		case err := <-done:
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			notify.notify("STOPPING=1", "STATUS=logging off")
+			if err := <-done; !errors.Is(err, context.Canceled) {
+				return err
+			}
+			return nil
+		case <-watchdog:
+			notify.notify("WATCHDOG=1")
+		case <-refresh.C:
+			st := m.Status()
+			notify.notify(fmt.Sprintf("STATUS=%d of %d sessions online", st.Online, st.Total))
+			if err := writeSessions(opts.runDir, st); err != nil {
+				logger.Warn("cannot write sessions file", "err", err)
+			}
+		}
+	}
+}
+
+// writeSessions replaces the sessions file atomically.
+func writeSessions(dir string, st rjsocks.ManagerStatus) error {
+	buf, err := json.MarshalIndent(struct {
+		PID int `json:"pid"`
+		rjsocks.ManagerStatus
+	}{os.Getpid(), st}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, sessionsFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(buf, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
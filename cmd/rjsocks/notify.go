@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notifier sends sd_notify(3) messages to systemd, it does nothing when not
+// started by a Type=notify unit.
+type notifier struct {
+	conn *net.UnixConn
+}
+
+func newNotifier() *notifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if len(path) == 0 {
+		return &notifier{}
+	}
+	// a leading @ names an abstract socket, which net understands as is
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return &notifier{}
+	}
+	return &notifier{conn: conn}
+}
+
+func (n *notifier) notify(state ...string) error {
+	if n.conn == nil {
+		return nil
+	}
+	_, err := n.conn.Write([]byte(strings.Join(state, "\n")))
+	return err
+}
+
+func (n *notifier) Close() error {
+	if n.conn == nil {
+		return nil
+	}
+	return n.conn.Close()
+}
+
+// watchdogInterval returns how often WATCHDOG=1 must be sent, zero if the
+// unit has no watchdog or it is meant for another process.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
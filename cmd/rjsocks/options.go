@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/config"
+	rjsocks "github.com/tr3ee/go-rjsocks/core"
+)
+
+// Without -config the profiles file is read if it exists, the ini file
+// otherwise.
+const (
+	defaultProfilesFile = "/etc/rjsocks/rjsocks.toml"
+	defaultConfigFile   = "/etc/rjsocks/rjsocks.ini"
+)
+
+var errUsage = errors.New("usage error")
+
+type options struct {
+	name         string
+	args         []string
+	config       string
+	user         string
+	password     string
+	passwordFrom string
+	iface        string
+	adapter      string
+	dialect      string
+	renew        string
+	timeout      time.Duration
+	json         bool
+	logSink      string
+	logLevel     string
+	runDir       string
+	control      string
+	profileName  string
+	// profiles is the TOML config, if one was read.
+	profiles *rjsocks.Config
+	// profile is the one chosen from a TOML config, it supplies the
+	// settings that have no flag.
+	profile *rjsocks.Profile
+	// rest holds the positional arguments of commands taking them.
+	rest []string
+}
+
+// parseOptions reads the config file first, flags given on the command line
+// take precedence over it.
+func parseOptions(name string, args []string) (*options, error) {
+	opts := &options{
+		name:     name,
+		args:     args,
+		runDir:   defaultRunDir,
+		dialect:  string(rjsocks.DialectRuijie),
+		renew:    rjsocks.RenewAuto,
+		timeout:  5 * time.Second,
+		logSink:  rjsocks.LogSinkStderr,
+		logLevel: "info",
+	}
+	fs := flag.NewFlagSet("rjsocks "+name, flag.ContinueOnError)
+	fs.StringVar(&opts.config, "config", "", "TOML profiles or ini file holding the settings below (default "+defaultProfilesFile+" or "+defaultConfigFile+")")
+	fs.StringVar(&opts.profileName, "profile", "", "profile of the TOML config to use, its default one if empty")
+	fs.StringVar(&opts.user, "user", "", "account name")
+	fs.StringVar(&opts.passwordFrom, "password-from", "", "where to read the password: env:NAME, file:PATH, cmd:COMMAND, prompt or stdin")
+	fs.StringVar(&opts.iface, "i", "", "interface to authenticate on")
+	fs.StringVar(&opts.adapter, "adapter", "", "network adapter if it differs from the capture device (windows)")
+	fs.StringVar(&opts.dialect, "dialect", opts.dialect, "ruijie or standard")
+	fs.StringVar(&opts.renew, "renew", opts.renew, "ip renewal after login: auto, none, dhcp, dhclient, udhcpc, dhcpcd, nmcli, ipconfig")
+	fs.DurationVar(&opts.timeout, "timeout", opts.timeout, "how long probe waits for an answer")
+	fs.BoolVar(&opts.json, "json", false, "print results as JSON")
+	fs.StringVar(&opts.logSink, "log", opts.logSink, "log sink: stderr, syslog, journal or file:PATH")
+	fs.StringVar(&opts.logLevel, "log-level", opts.logLevel, "debug, info, warn or error")
+	fs.StringVar(&opts.runDir, "run-dir", opts.runDir, "where the daemon keeps its pid and status files")
+	fs.StringVar(&opts.control, "control", "", "control endpoint: unix:PATH, 127.0.0.1:PORT or none (default unix:RUN-DIR/"+controlSocketName+")")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, err
+		}
+		return nil, withCode(exitUsage, err)
+	}
+	opts.rest = fs.Args()
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	path, required := opts.config, true
+	if len(path) == 0 {
+		path, required = defaultConfigFile, false
+		if _, err := os.Stat(defaultProfilesFile); err == nil {
+			path = defaultProfilesFile
+		}
+	}
+	load := opts.load
+	if filepath.Ext(path) == ".toml" {
+		load = opts.loadProfile
+	} else if len(opts.profileName) > 0 {
+		return opts, withCode(exitUsage, fmt.Errorf("%w: -profile needs a TOML config", errUsage))
+	}
+	if err := load(path, required, set); err != nil {
+		return opts, withCode(exitUsage, err)
+	}
+	if len(opts.adapter) == 0 {
+		opts.adapter = opts.iface
+	}
+	return opts, nil
+}
+
+// load fills the options not set by flags from the ini file at path.
+func (opts *options) load(path string, required bool, set map[string]bool) error {
+	if _, err := os.Stat(path); err != nil {
+		if !required && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	conf, err := config.NewConfig("ini", path)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	for key, dst := range map[string]*string{
+		"user":          &opts.user,
+		"password-from": &opts.passwordFrom,
+		"i":             &opts.iface,
+		"adapter":       &opts.adapter,
+		"dialect":       &opts.dialect,
+		"renew":         &opts.renew,
+		"log":           &opts.logSink,
+		"log-level":     &opts.logLevel,
+		"run-dir":       &opts.runDir,
+		"control":       &opts.control,
+	} {
+		if !set[key] {
+			*dst = conf.DefaultString(iniKey(key), *dst)
+		}
+	}
+	// a password is only ever read from the file, never from a flag
+	opts.password = conf.DefaultString("password", "")
+	return nil
+}
+
+// loadProfile fills the options not set by flags from a profile of the
+// TOML config at path.
+func (opts *options) loadProfile(path string, required bool, set map[string]bool) error {
+	if _, err := os.Stat(path); err != nil {
+		if !required && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	conf, err := rjsocks.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	opts.profiles = conf
+	if opts.name == multiCommand {
+		// it runs a list of profiles, see runMulti
+		return nil
+	}
+	p, err := conf.Profile(opts.profileName)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for key, val := range map[string]struct {
+		dst *string
+		src string
+	}{
+		"user":          {&opts.user, p.User},
+		"password-from": {&opts.passwordFrom, p.PasswordFrom},
+		"i":             {&opts.iface, p.Interface},
+		"adapter":       {&opts.adapter, p.Adapter},
+		"dialect":       {&opts.dialect, string(p.Dialect)},
+		"renew":         {&opts.renew, p.Renew},
+	} {
+		if !set[key] && len(val.src) > 0 {
+			*val.dst = val.src
+		}
+	}
+	opts.password = p.Password
+	opts.profile = p
+	return nil
+}
+
+// iniKey maps a flag name to its key in the ini file.
+func iniKey(flagName string) string {
+	switch flagName {
+	case "user":
+		return "username"
+	case "i":
+		return "interface"
+	}
+	return strings.ReplaceAll(flagName, "-", "_")
+}
+
+// validate checks what a session needs besides the password.
+func (opts *options) validate() error {
+	if err := opts.needInterface(); err != nil {
+		return err
+	}
+	if len(opts.user) == 0 {
+		return withCode(exitUsage, fmt.Errorf("%w: no user given, use -user", errUsage))
+	}
+	if err := opts.sessionProfile().Validate(); err != nil {
+		return withCode(exitUsage, err)
+	}
+	return nil
+}
+
+// sessionProfile merges the flags into the profile, the password is
+// resolved separately.
+func (opts *options) sessionProfile() *rjsocks.Profile {
+	p := new(rjsocks.Profile)
+	if opts.profile != nil {
+		*p = *opts.profile
+	}
+	p.User, p.Interface, p.Adapter = opts.user, opts.iface, opts.adapter
+	p.Dialect, p.Renew = rjsocks.Dialect(opts.dialect), opts.renew
+	p.Password, p.PasswordFrom = "", ""
+	return p
+}
+
+func (opts *options) needInterface() error {
+	if len(opts.iface) == 0 {
+		return withCode(exitUsage, fmt.Errorf("%w: no interface given, use -i", errUsage))
+	}
+	return nil
+}
+
+// resolvePassword reads the password named by -password-from, or takes the
+// one of the config file. The caller should clear it once done.
+func (opts *options) resolvePassword() ([]byte, error) {
+	var src rjsocks.PasswordSource = rjsocks.StaticPassword(opts.password)
+	if len(opts.passwordFrom) > 0 {
+		var err error
+		if src, err = rjsocks.ParsePasswordSource(opts.passwordFrom); err != nil {
+			return nil, withCode(exitUsage, fmt.Errorf("%w: %v", errUsage, err))
+		}
+	}
+	pass, err := src.Password()
+	if errors.Is(err, rjsocks.ErrNoPassword) && len(opts.passwordFrom) == 0 {
+		return nil, withCode(exitUsage, fmt.Errorf("%w: no password, use -password-from", errUsage))
+	}
+	if err != nil {
+		return nil, withCode(exitUsage, err)
+	}
+	return pass, nil
+}
+
+// logger opens the log sink, the closer must be called on exit.
+func (opts *options) logger() (*slog.Logger, io.Closer, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.logLevel)); err != nil {
+		return nil, nil, withCode(exitUsage, err)
+	}
+	sink, target, _ := strings.Cut(opts.logSink, ":")
+	l, closer, err := rjsocks.OpenLogger(sink, target, level)
+	if err != nil {
+		return nil, nil, withCode(exitUsage, err)
+	}
+	return l, closer, nil
+}
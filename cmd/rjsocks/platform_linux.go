@@ -0,0 +1,9 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
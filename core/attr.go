@@ -0,0 +1,241 @@
+package rjsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ruijieVendor is the vendor id (0x1311) prefixing every Ruijie private field.
+var ruijieVendor = []byte{0x00, 0x00, 0x13, 0x11}
+
+// AttrType identifies a vendor attribute in the Ruijie private block.
+type AttrType uint8
+
+const (
+	AttrClientHash AttrType = 0x17
+	AttrStatus     AttrType = 0x18
+	AttrMacAddr    AttrType = 0x2d
+	AttrIPv6Local  AttrType = 0x36
+	AttrIPv6Temp   AttrType = 0x38
+	AttrIPv6Global AttrType = 0x39
+	// AttrKeepAlive is the heartbeat period in seconds, 4 bytes big endian,
+	// found in some EAP-Success frames.
+	AttrKeepAlive    AttrType = 0x3c
+	AttrClientHashV2 AttrType = 0x4d
+	AttrHostname     AttrType = 0x54
+)
+
+const (
+	attrMagic     = 0x1a
+	attrHeaderLen = 8 // magic, length, vendor, type, value length
+	ipInfoLen     = 0x17
+	clientFileLen = 32
+)
+
+var (
+	ErrShortTrailer = errors.New("ruijie trailer too short")
+	ErrBadAttribute = errors.New("malformed ruijie attribute")
+)
+
+// Attribute is a single `0x1a len 00 00 13 11 type len value` field.
+type Attribute struct {
+	Type  AttrType
+	Value []byte
+}
+
+// Attributes is an ordered attribute list, the order is kept on the wire.
+type Attributes []Attribute
+
+// Get returns the value of the first attribute of type t.
+func (a Attributes) Get(t AttrType) ([]byte, bool) {
+	for _, attr := range a {
+		if attr.Type == t {
+			return attr.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Set replaces the value of the first attribute of type t, or appends a new
+// attribute if there is none.
+func (a Attributes) Set(t AttrType, value []byte) Attributes {
+	for i := range a {
+		if a[i].Type == t {
+			a[i].Value = value
+			return a
+		}
+	}
+	return append(a, Attribute{Type: t, Value: value})
+}
+
+// Len returns the encoded length of the list.
+func (a Attributes) Len() int {
+	n := 0
+	for _, attr := range a {
+		n += attrHeaderLen + len(attr.Value)
+	}
+	return n
+}
+
+func (a Attributes) appendTo(buf []byte) ([]byte, error) {
+	for _, attr := range a {
+		if attrHeaderLen+len(attr.Value) > 0xff {
+			return nil, fmt.Errorf("%w: type 0x%02x value too long (%d)", ErrBadAttribute, uint8(attr.Type), len(attr.Value))
+		}
+		buf = append(buf, attrMagic, byte(attrHeaderLen+len(attr.Value)))
+		buf = append(buf, ruijieVendor...)
+		buf = append(buf, byte(attr.Type), byte(len(attr.Value)+2))
+		buf = append(buf, attr.Value...)
+	}
+	return buf, nil
+}
+
+// ParseAttributes decodes a complete attribute list.
+func ParseAttributes(buf []byte) (Attributes, error) {
+	var ret Attributes
+	for len(buf) > 0 {
+		if len(buf) < attrHeaderLen {
+			return nil, fmt.Errorf("%w: %d trailing bytes", ErrBadAttribute, len(buf))
+		}
+		n := int(buf[1])
+		switch {
+		case buf[0] != attrMagic:
+			return nil, fmt.Errorf("%w: bad magic 0x%02x", ErrBadAttribute, buf[0])
+		case n < attrHeaderLen || n > len(buf):
+			return nil, fmt.Errorf("%w: bad length %d", ErrBadAttribute, n)
+		case !bytes.Equal(buf[2:6], ruijieVendor):
+			return nil, fmt.Errorf("%w: unknown vendor %x", ErrBadAttribute, buf[2:6])
+		case int(buf[7]) != n-6:
+			return nil, fmt.Errorf("%w: type 0x%02x length mismatch", ErrBadAttribute, buf[6])
+		}
+		value := make([]byte, n-attrHeaderLen)
+		copy(value, buf[attrHeaderLen:n])
+		ret = append(ret, Attribute{Type: AttrType(buf[6]), Value: value})
+		buf = buf[n:]
+	}
+	return ret, nil
+}
+
+// Trailer is the Ruijie private block appended to Start and Response frames.
+type Trailer struct {
+	IPInfo IPInfo
+	// ClientFile is the client executable name, at most 32 bytes.
+	ClientFile string
+	Version    [4]byte
+	Flag       byte
+	Attributes Attributes
+	// Padding is the number of zero bytes following the attributes.
+	Padding int
+}
+
+// NewTrailer returns the trailer sent by the official 8021x.exe client.
+func NewTrailer() *Trailer {
+	return &Trailer{
+		ClientFile: "8021x.exe",
+		Version:    [4]byte{0x04, 0x0a, 0x00, 0x02},
+		Attributes: Attributes{
+			{AttrClientHash, []byte("68DC123B7EB239F23A8C000388498639")},
+			{AttrStatus, []byte{0x00, 0x00, 0x00, 0x00}},
+			{AttrMacAddr, make([]byte, 6)},
+			{0x2f, nil},
+			{0x35, []byte{0x01}},
+			{AttrIPv6Local, make([]byte, 16)},
+			{AttrIPv6Temp, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xfe, 0x86, 0x13, 0x4c}},
+			{AttrClientHashV2, []byte("68dc123b07eb239f23a80dcf25875d05770c721e45645e537ab351bb63155ae1626167eb09223e2a0a78031161ac09da2dc073693a4f5a29286751f97f4d0468")},
+			{AttrIPv6Global, make([]byte, 32)},
+			{AttrHostname, append([]byte("HUSTMOON"), make([]byte, 56)...)},
+			{0x55, nil},
+			{0x62, []byte{0x00}},
+		},
+		Padding: 5,
+	}
+}
+
+// Clone returns a deep copy of t.
+func (t *Trailer) Clone() *Trailer {
+	ret := *t
+	ret.IPInfo.IP = append(net.IP(nil), t.IPInfo.IP...)
+	ret.IPInfo.Mask = append(net.IPMask(nil), t.IPInfo.Mask...)
+	ret.IPInfo.Gateway = append(net.IP(nil), t.IPInfo.Gateway...)
+	ret.IPInfo.DNS = append(net.IP(nil), t.IPInfo.DNS...)
+	ret.Attributes = make(Attributes, len(t.Attributes))
+	for i, attr := range t.Attributes {
+		ret.Attributes[i] = Attribute{Type: attr.Type, Value: append([]byte(nil), attr.Value...)}
+	}
+	return &ret
+}
+
+// MarshalBinary encodes the trailer as it appears on the wire.
+func (t *Trailer) MarshalBinary() ([]byte, error) {
+	if len(t.ClientFile) > clientFileLen {
+		return nil, fmt.Errorf("client file name %q longer than %d bytes", t.ClientFile, clientFileLen)
+	}
+	n := t.Attributes.Len()
+	if n > 0xffff {
+		return nil, fmt.Errorf("%w: attribute list too long (%d)", ErrBadAttribute, n)
+	}
+	info, err := t.IPInfo.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, ipInfoLen+47+n+t.Padding)
+	buf = append(buf, info...)
+	buf = append(buf, ruijieVendor...)
+	file := make([]byte, clientFileLen)
+	copy(file, t.ClientFile)
+	buf = append(buf, file...)
+	buf = append(buf, t.Version[:]...)
+	buf = append(buf, t.Flag)
+	buf = append(buf, ruijieVendor...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	buf, err = t.Attributes.appendTo(buf)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, make([]byte, t.Padding)...), nil
+}
+
+// UnmarshalBinary decodes a trailer previously produced by MarshalBinary or
+// captured from the official client.
+func (t *Trailer) UnmarshalBinary(buf []byte) error {
+	const fixedLen = ipInfoLen + 4 + clientFileLen + 4 + 1 + 4 + 2
+	if len(buf) < fixedLen {
+		return ErrShortTrailer
+	}
+	var ret Trailer
+	if err := ret.IPInfo.UnmarshalBinary(buf); err != nil {
+		return err
+	}
+	p := buf[ipInfoLen:]
+	if !bytes.Equal(p[:4], ruijieVendor) {
+		return fmt.Errorf("%w: unknown vendor %x", ErrBadAttribute, p[:4])
+	}
+	ret.ClientFile = string(bytes.TrimRight(p[4:4+clientFileLen], "\x00"))
+	p = p[4+clientFileLen:]
+	copy(ret.Version[:], p)
+	ret.Flag = p[4]
+	if !bytes.Equal(p[5:9], ruijieVendor) {
+		return fmt.Errorf("%w: unknown vendor %x", ErrBadAttribute, p[5:9])
+	}
+	n := int(binary.BigEndian.Uint16(p[9:11]))
+	p = p[11:]
+	if len(p) < n {
+		return ErrShortTrailer
+	}
+	attrs, err := ParseAttributes(p[:n])
+	if err != nil {
+		return err
+	}
+	ret.Attributes = attrs
+	for _, b := range p[n:] {
+		if b != 0 {
+			return fmt.Errorf("%w: garbage after attributes", ErrBadAttribute)
+		}
+	}
+	ret.Padding = len(p) - n
+	*t = ret
+	return nil
+}
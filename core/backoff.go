@@ -0,0 +1,126 @@
+package rjsocks
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// BackoffPolicy decides how long to wait before retrying a failed login.
+type BackoffPolicy interface {
+	// Delay returns the wait before retry number attempt, counting from 0,
+	// and false once the service should give up.
+	Delay(attempt int) (time.Duration, bool)
+	// ResetOnSuccess reports whether a successful login restarts counting.
+	ResetOnSuccess() bool
+}
+
+type BackoffStrategy int
+
+const (
+	// BackoffQuadratic waits Base * attempt², i.e. 0 1 4 9 16 25...
+	BackoffQuadratic = BackoffStrategy(iota)
+	// BackoffExponential waits Base * 2^attempt.
+	BackoffExponential
+	// BackoffConstant always waits Base.
+	BackoffConstant
+)
+
+var backoffStrategyNames = []string{"quadratic", "exponential", "constant"}
+
+func (b BackoffStrategy) String() string {
+	if b < 0 || int(b) >= len(backoffStrategyNames) {
+		return fmt.Sprintf("BackoffStrategy(%d)", int(b))
+	}
+	return backoffStrategyNames[b]
+}
+
+func (b BackoffStrategy) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText accepts the names printed by String.
+func (b *BackoffStrategy) UnmarshalText(text []byte) error {
+	for i, name := range backoffStrategyNames {
+		if name == string(text) {
+			*b = BackoffStrategy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown backoff strategy %q", text)
+}
+
+// Backoff is the stock BackoffPolicy.
+type Backoff struct {
+	Strategy BackoffStrategy `toml:"strategy"`
+	Base     time.Duration   `toml:"base"`
+	// Max caps a single delay, 0 means no cap.
+	Max time.Duration `toml:"max"`
+	// Jitter randomly shortens or lengthens each delay by up to this
+	// fraction, e.g. 0.2 for ±20%.
+	Jitter float64 `toml:"jitter"`
+	// MaxAttempts is the number of retries before giving up, 0 means never
+	// give up.
+	MaxAttempts int `toml:"max_attempts"`
+	// Reset restarts counting after a successful login.
+	Reset bool `toml:"reset"`
+}
+
+// DefaultBackoff mirrors the historical behaviour of squaring the number of
+// failures, capped at five minutes.
+var DefaultBackoff BackoffPolicy = &Backoff{
+	Strategy: BackoffQuadratic,
+	Base:     time.Second,
+	Max:      5 * time.Minute,
+	Jitter:   0.1,
+	Reset:    true,
+}
+
+func ExponentialBackoff(base, max time.Duration) *Backoff {
+	return &Backoff{Strategy: BackoffExponential, Base: base, Max: max, Reset: true}
+}
+
+func QuadraticBackoff(base, max time.Duration) *Backoff {
+	return &Backoff{Strategy: BackoffQuadratic, Base: base, Max: max, Reset: true}
+}
+
+func ConstantBackoff(d time.Duration) *Backoff {
+	return &Backoff{Strategy: BackoffConstant, Base: d, Reset: true}
+}
+
+func (b *Backoff) Delay(attempt int) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+		return 0, false
+	}
+	// growth is computed in float64 so large attempts saturate instead of
+	// overflowing
+	var d float64
+	switch b.Strategy {
+	case BackoffExponential:
+		d = float64(b.Base)
+		for i := 0; i < attempt && d < float64(1<<62); i++ {
+			d *= 2
+		}
+	case BackoffQuadratic:
+		d = float64(b.Base) * float64(attempt) * float64(attempt)
+	default:
+		d = float64(b.Base)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if d > float64(1<<62) {
+		d = float64(1 << 62)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d), true
+}
+
+func (b *Backoff) ResetOnSuccess() bool {
+	return b.Reset
+}
@@ -0,0 +1,409 @@
+package rjsocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ConfigVersion is the version of the config format understood here.
+const ConfigVersion = 1
+
+// Config is a TOML file of named profiles, e.g.
+//
+//	version = 1
+//	default = "dorm"
+//
+//	[profiles.dorm]
+//	user = "2017xxxx"
+//	password_from = "env:RJSOCKS_PASSWORD"
+//	interface = "eth0"
+//	renew = "dhcp"
+//
+//	[profiles.lab]
+//	user = "lab01"
+//	interface = "eth1"
+//	dialect = "standard"
+//	backoff = { strategy = "exponential", base = "2s", max = "10m" }
+//	hooks = { online = ["/etc/rjsocks/online.sh"] }
+//
+//	[profiles.rack1]
+//	user = "lab02"
+//	interface = "rj-rack1"
+//	macvlan = { parent = "eth1", mac = "02:00:00:00:01:01" }
+type Config struct {
+	Version int `toml:"version"`
+	// Default names the profile used when none is asked for, it may be
+	// left out when there is a single profile.
+	Default  string              `toml:"default"`
+	Profiles map[string]*Profile `toml:"profiles"`
+}
+
+// Profile is everything needed to run one session.
+type Profile struct {
+	Name string `toml:"-"`
+	User string `toml:"user"`
+	// Password is kept in the file as is, prefer PasswordFrom.
+	Password string `toml:"password"`
+	// PasswordFrom names where the password is read from, see
+	// ParsePasswordSource.
+	PasswordFrom string `toml:"password_from"`
+	Interface    string `toml:"interface"`
+	// Adapter is the network adapter if it differs from the capture
+	// device, windows only.
+	Adapter string  `toml:"adapter"`
+	Dialect Dialect `toml:"dialect"`
+	// Multicast overrides the group address of the dialect.
+	Multicast string `toml:"multicast"`
+	// Renew is a renew method, see NewRenewer, or RenewDHCP.
+	Renew   string   `toml:"renew"`
+	Backoff *Backoff `toml:"backoff"`
+	Hooks   Hooks    `toml:"hooks"`
+	// Macvlan has Interface created as a macvlan, linux only.
+	Macvlan *Macvlan `toml:"macvlan"`
+}
+
+// Macvlan is a virtual interface with its own MAC address on top of a
+// physical one, letting several sessions authenticate through one NIC.
+type Macvlan struct {
+	Parent string `toml:"parent"`
+	MAC    string `toml:"mac"`
+}
+
+// ConfigError lists everything wrong with a config file, one problem per
+// line.
+type ConfigError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	prefix := ""
+	if len(e.Path) > 0 {
+		prefix = e.Path + ": "
+	}
+	return prefix + strings.Join(e.Problems, "\n"+prefix)
+}
+
+// LoadConfig reads and validates the config file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ParseConfig(data)
+	var ce *ConfigError
+	if errors.As(err, &ce) {
+		ce.Path = path
+	}
+	return c, err
+}
+
+// ParseConfig decodes and validates a config, a *ConfigError tells what is
+// wrong with it.
+func ParseConfig(data []byte) (*Config, error) {
+	var c Config
+	md, err := toml.Decode(string(data), &c)
+	if err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			return nil, &ConfigError{Problems: []string{fmt.Sprintf("line %d: %s", pe.Position.Line, pe.Message)}}
+		}
+		return nil, &ConfigError{Problems: []string{strings.TrimPrefix(err.Error(), "toml: ")}}
+	}
+	var problems []string
+	for _, key := range md.Undecoded() {
+		problems = append(problems, fmt.Sprintf("%s: unknown key", key))
+	}
+	for name, p := range c.Profiles {
+		if p == nil {
+			continue
+		}
+		p.Name = name
+		if p.Backoff != nil {
+			p.Backoff.fillDefaults(func(key string) bool {
+				return md.IsDefined("profiles", name, "backoff", key)
+			})
+		}
+	}
+	problems = append(problems, c.problems()...)
+	if len(problems) > 0 {
+		return &c, &ConfigError{Problems: problems}
+	}
+	return &c, nil
+}
+
+// fillDefaults takes what the file left out from DefaultBackoff.
+func (b *Backoff) fillDefaults(defined func(key string) bool) {
+	def, ok := DefaultBackoff.(*Backoff)
+	if !ok {
+		return
+	}
+	if !defined("strategy") {
+		b.Strategy = def.Strategy
+	}
+	if !defined("base") {
+		b.Base = def.Base
+	}
+	if !defined("max") {
+		b.Max = def.Max
+	}
+	if !defined("jitter") {
+		b.Jitter = def.Jitter
+	}
+	if !defined("reset") {
+		b.Reset = def.Reset
+	}
+}
+
+func (c *Config) problems() []string {
+	var problems []string
+	switch {
+	case c.Version == 0:
+		problems = append(problems, fmt.Sprintf("version: missing, set version = %d", ConfigVersion))
+	case c.Version != ConfigVersion:
+		problems = append(problems, fmt.Sprintf("version: unsupported version %d, this build reads version %d", c.Version, ConfigVersion))
+	}
+	if len(c.Profiles) == 0 {
+		problems = append(problems, "profiles: no profile defined")
+	} else if len(c.Default) > 0 && c.Profiles[c.Default] == nil {
+		problems = append(problems, fmt.Sprintf("default: no profile named %q", c.Default))
+	}
+	for _, name := range c.Names() {
+		for _, err := range c.Profiles[name].problems() {
+			problems = append(problems, fmt.Sprintf("profiles.%s.%v", name, err))
+		}
+	}
+	return problems
+}
+
+// Names returns the profile names in order.
+func (c *Config) Names() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile returns the profile called name, the default one if name is
+// empty.
+func (c *Config) Profile(name string) (*Profile, error) {
+	if len(name) == 0 {
+		name = c.Default
+	}
+	if len(name) == 0 {
+		if len(c.Profiles) != 1 {
+			return nil, fmt.Errorf("no default profile, choose one of %s", strings.Join(c.Names(), ", "))
+		}
+		name = c.Names()[0]
+	}
+	p := c.Profiles[name]
+	if p == nil {
+		return nil, fmt.Errorf("no profile named %q, choose one of %s", name, strings.Join(c.Names(), ", "))
+	}
+	return p, nil
+}
+
+// Validate reports every invalid setting of p.
+func (p *Profile) Validate() error {
+	return errors.Join(p.problems()...)
+}
+
+// problems returns one error per invalid setting, each starting with its
+// key.
+func (p *Profile) problems() []error {
+	if p == nil {
+		return []error{errors.New("empty profile")}
+	}
+	var errs []error
+	bad := func(key, format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, a...)))
+	}
+	if len(p.User) == 0 {
+		bad("user", "missing")
+	}
+	if len(p.Interface) == 0 {
+		bad("interface", "missing")
+	}
+	if len(p.Password) > 0 && len(p.PasswordFrom) > 0 {
+		bad("password_from", "cannot be combined with password")
+	}
+	if len(p.PasswordFrom) > 0 {
+		if _, err := ParsePasswordSource(p.PasswordFrom); err != nil {
+			bad("password_from", "%v", err)
+		}
+	}
+	if _, err := ParseDialect(string(p.Dialect)); err != nil {
+		bad("dialect", "%v, want %s or %s", err, DialectRuijie, DialectStandard)
+	}
+	if len(p.Multicast) > 0 {
+		if mac, err := net.ParseMAC(p.Multicast); err != nil {
+			bad("multicast", "%q is not a MAC address", p.Multicast)
+		} else if len(mac) != 6 || mac[0]&1 == 0 {
+			bad("multicast", "%s is not an ethernet multicast address", mac)
+		}
+	}
+	if p.Renew != RenewDHCP {
+		if _, err := NewRenewer(p.Renew); err != nil {
+			bad("renew", "%v", err)
+		}
+	}
+	if b := p.Backoff; b != nil {
+		if b.Strategy < BackoffQuadratic || b.Strategy > BackoffConstant {
+			bad("backoff.strategy", "unknown strategy %v", b.Strategy)
+		}
+		if b.Base <= 0 {
+			bad("backoff.base", "must be positive, got %v", b.Base)
+		}
+		if b.Max < 0 {
+			bad("backoff.max", "must not be negative, got %v", b.Max)
+		}
+		if b.Jitter < 0 || b.Jitter >= 1 {
+			bad("backoff.jitter", "must be in [0, 1), got %v", b.Jitter)
+		}
+		if b.MaxAttempts < 0 {
+			bad("backoff.max_attempts", "must not be negative, got %d", b.MaxAttempts)
+		}
+	}
+	for _, hook := range []struct {
+		key  string
+		argv []string
+	}{{HookOnline, p.Hooks.Online}, {HookOffline, p.Hooks.Offline}, {HookFailure, p.Hooks.Failure}} {
+		if len(hook.argv) > 0 && len(hook.argv[0]) == 0 {
+			bad("hooks."+hook.key, "the program is empty")
+		}
+	}
+	if m := p.Macvlan; m != nil {
+		switch {
+		case len(m.Parent) == 0:
+			bad("macvlan.parent", "missing")
+		case m.Parent == p.Interface:
+			bad("macvlan.parent", "must differ from the interface")
+		}
+		if mac, err := net.ParseMAC(m.MAC); err != nil || len(mac) != 6 {
+			bad("macvlan.mac", "%q is not a MAC address", m.MAC)
+		} else if mac[0]&1 != 0 {
+			bad("macvlan.mac", "%s is a multicast address", mac)
+		}
+		if len(p.Interface) > 15 {
+			bad("interface", "%q is too long for a macvlan, 15 bytes at most", p.Interface)
+		}
+	}
+	if p.Hooks.Timeout < 0 {
+		bad("hooks.timeout", "must not be negative, got %v", p.Hooks.Timeout)
+	}
+	return errs
+}
+
+// BackoffPolicy returns the profile's policy, DefaultBackoff if it has
+// none.
+func (p *Profile) BackoffPolicy() BackoffPolicy {
+	if p.Backoff == nil {
+		return DefaultBackoff
+	}
+	return p.Backoff
+}
+
+// PasswordSource returns where the profile's password comes from.
+func (p *Profile) PasswordSource() (PasswordSource, error) {
+	switch {
+	case len(p.PasswordFrom) > 0:
+		return ParsePasswordSource(p.PasswordFrom)
+	case len(p.Password) > 0:
+		return StaticPassword(p.Password), nil
+	}
+	return nil, ErrNoPassword
+}
+
+// NewService opens the profile's interface and applies its settings. The
+// password is read from src, or from the profile's own source if src is
+// nil.
+func (p *Profile) NewService(src PasswordSource) (*Service, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if src == nil {
+		var err error
+		if src, err = p.PasswordSource(); err != nil {
+			return nil, err
+		}
+	}
+	adapter := p.Adapter
+	if len(adapter) == 0 {
+		adapter = p.Interface
+	}
+	cleanup, err := p.setupMacvlan()
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewServiceFrom(p.User, src, p.Interface, adapter)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	s.cleanup = cleanup
+	if err := p.Apply(s); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// setupMacvlan creates the profile's macvlan, the returned func removes it
+// again unless it existed before.
+func (p *Profile) setupMacvlan() (func(), error) {
+	if p.Macvlan == nil {
+		return func() {}, nil
+	}
+	mac, err := net.ParseMAC(p.Macvlan.MAC)
+	if err != nil {
+		return nil, err
+	}
+	created, err := CreateMacvlan(p.Interface, p.Macvlan.Parent, mac)
+	if err != nil {
+		return nil, fmt.Errorf("creating macvlan %s on %s: %w", p.Interface, p.Macvlan.Parent, err)
+	}
+	if !created {
+		return func() {}, nil
+	}
+	return func() { DeleteLink(p.Interface) }, nil
+}
+
+// Apply configures s with everything of p but the account and interface.
+func (p *Profile) Apply(s *Service) error {
+	dialect, err := ParseDialect(string(p.Dialect))
+	if err != nil {
+		return err
+	}
+	s.SetDialect(dialect)
+	if len(p.Multicast) > 0 {
+		mac, err := net.ParseMAC(p.Multicast)
+		if err != nil {
+			return err
+		}
+		if err := s.SetGroupAddr(mac); err != nil {
+			return err
+		}
+	}
+	if p.Renew == RenewDHCP {
+		if err := s.EnableDHCP(DefaultConfigurator()); err != nil {
+			return err
+		}
+	} else {
+		r, err := NewRenewer(p.Renew)
+		if err != nil {
+			return err
+		}
+		s.SetRenewer(r)
+	}
+	s.SetBackoffPolicy(p.BackoffPolicy())
+	s.SetHooks(p.Hooks)
+	return nil
+}
@@ -0,0 +1,287 @@
+package rjsocks
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrControlNotLocal is returned for control addresses reachable from
+	// other hosts.
+	ErrControlNotLocal = errors.New("control address must be a unix socket or a loopback address")
+	// ErrControlToken is returned when a TCP control address has no token.
+	ErrControlToken = errors.New("a tcp control address needs a token")
+)
+
+// Control actions, each is served as POST /v1/<action>.
+const (
+	ControlStop     = "stop"
+	ControlContinue = "continue"
+	ControlReauth   = "reauth"
+	ControlLogoff   = "logoff"
+	ControlReload   = "reload"
+)
+
+// ControlEvent is a StateEvent as streamed by GET /v1/events, one JSON
+// object per line.
+type ControlEvent struct {
+	Time  time.Time `json:"time"`
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	Cause string    `json:"cause,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+func NewControlEvent(ev StateEvent) ControlEvent {
+	e := ControlEvent{Time: ev.Time, From: ev.From.Name(), To: ev.To.Name(), Cause: ev.Cause}
+	if ev.Err != nil {
+		e.Error = ev.Err.Error()
+	}
+	return e
+}
+
+// ControlServer exposes a running Service over HTTP:
+//
+//	GET  /v1/status   the Status of the service
+//	GET  /v1/events   state transitions until the service closes
+//	POST /v1/<action> stop, continue, reauth, logoff or reload, answered
+//	                  with the resulting Status
+//
+// Errors are answered as {"error": "..."}.
+type ControlServer struct {
+	// Token has to be sent as "Authorization: Bearer <token>" unless empty.
+	Token string
+	// Reload serves the reload action, which is refused when nil.
+	Reload func() error
+	// Logoff serves the logoff action, Service.Close when nil.
+	Logoff func() error
+
+	mu  sync.Mutex
+	srv *Service
+	mux *http.ServeMux
+}
+
+func NewControlServer(s *Service, token string) *ControlServer {
+	c := &ControlServer{Token: token, srv: s, mux: http.NewServeMux()}
+	c.mux.HandleFunc("GET /v1/status", c.serveStatus)
+	c.mux.HandleFunc("GET /v1/events", c.serveEvents)
+	c.mux.HandleFunc("POST /v1/{action}", c.serveAction)
+	return c
+}
+
+// SetService points the server at s, e.g. after a session was restarted.
+// Running event streams end with the old service.
+func (c *ControlServer) SetService(s *Service) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.srv = s
+}
+
+func (c *ControlServer) service() *Service {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.srv
+}
+
+func (c *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(c.Token) > 0 {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) != 1 {
+			controlError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+			return
+		}
+	}
+	if c.service() == nil {
+		controlError(w, http.StatusServiceUnavailable, errors.New("no session running"))
+		return
+	}
+	c.mux.ServeHTTP(w, r)
+}
+
+func (c *ControlServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	controlReply(w, c.service().Status())
+}
+
+func (c *ControlServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	events, cancel := c.service().Subscribe()
+	defer cancel()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if enc.Encode(NewControlEvent(ev)) != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func (c *ControlServer) serveAction(w http.ResponseWriter, r *http.Request) {
+	s := c.service()
+	var err error
+	switch action := r.PathValue("action"); action {
+	case ControlStop:
+		s.Stop()
+	case ControlContinue:
+		s.Continue()
+	case ControlReauth:
+		err = s.Reauth()
+	case ControlLogoff:
+		if c.Logoff != nil {
+			err = c.Logoff()
+		} else {
+			s.Close()
+		}
+	case ControlReload:
+		if c.Reload == nil {
+			controlError(w, http.StatusNotImplemented, errors.New("reload is not supported"))
+			return
+		}
+		err = c.Reload()
+		// a reload may have replaced the service
+		s = c.service()
+	default:
+		controlError(w, http.StatusNotFound, fmt.Errorf("unknown action %q", action))
+		return
+	}
+	if err != nil {
+		controlError(w, http.StatusInternalServerError, err)
+		return
+	}
+	controlReply(w, s.Status())
+}
+
+func controlReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func controlError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// ListenControl listens on addr, either "unix:PATH" or a loopback
+// "host:port". A unix socket left over by a previous run is replaced and
+// the new one is only accessible to its owner.
+func ListenControl(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return listenPrivateUnix(path)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%w: %s", ErrControlNotLocal, addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenPrivateUnix binds the socket inside a fresh 0700 directory and only
+// moves it to path once it is 0600, so nobody can connect in between.
+func listenPrivateUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".rjsocks-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "control.sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket file moves away, unixListener removes it instead
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ln, path: path}, nil
+}
+
+// unixListener reports and removes the socket under its final path.
+type unixListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// ServeControl serves c on addr until ctx is cancelled, see Serve.
+func ServeControl(ctx context.Context, addr string, c *ControlServer) error {
+	if !strings.HasPrefix(addr, "unix:") && len(c.Token) == 0 {
+		return ErrControlToken
+	}
+	ln, err := ListenControl(addr)
+	if err != nil {
+		return err
+	}
+	return c.Serve(ctx, ln)
+}
+
+// Serve serves c on ln until ctx is cancelled and closes ln. TCP listeners
+// require c to have a token, unix sockets rely on file permissions.
+func (c *ControlServer) Serve(ctx context.Context, ln net.Listener) error {
+	if ln.Addr().Network() != "unix" && len(c.Token) == 0 {
+		ln.Close()
+		return ErrControlToken
+	}
+	srv := &http.Server{Handler: c, ReadHeaderTimeout: 10 * time.Second}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			srv.Close()
+		case <-stop:
+		}
+	}()
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package rjsocks
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenControlUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rjsocks.sock")
+	// a socket left over by a crashed run
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := ListenControl("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode %v", fi.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("%d entries left in the socket directory", len(entries))
+	}
+	if ln.Addr().String() != path {
+		t.Fatalf("listening on %v", ln.Addr())
+	}
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	ln.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket left after Close: %v", err)
+	}
+}
+
+func TestListenControlNotLocal(t *testing.T) {
+	if _, err := ListenControl("0.0.0.0:0"); !errors.Is(err, ErrControlNotLocal) {
+		t.Fatalf("listening on all addresses: %v", err)
+	}
+}
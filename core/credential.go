@@ -0,0 +1,243 @@
+package rjsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	ErrCredentialNotFound = errors.New("credential not found")
+	// ErrCredentialKey is returned when a FileStore cannot be decrypted.
+	ErrCredentialKey = errors.New("wrong passphrase or key file")
+)
+
+// CredentialStore keeps passwords by account name.
+type CredentialStore interface {
+	// Get returns ErrCredentialNotFound for unknown users.
+	Get(user string) (string, error)
+	Set(user, password string) error
+	// Delete does nothing for unknown users.
+	Delete(user string) error
+}
+
+const (
+	credentialFileVersion = 1
+	kdfScrypt             = "scrypt"
+	kdfKeyFile            = "keyfile"
+	// credentialAAD binds the ciphertext to this format.
+	credentialAAD = "rjsocks credentials v1"
+)
+
+// credentialFile is the layout of a FileStore on disk, Data is the nonce
+// followed by the sealed JSON map of users to passwords.
+type credentialFile struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Data    []byte `json:"data"`
+}
+
+func kdfName(kdf string) string {
+	switch kdf {
+	case kdfScrypt:
+		return "a passphrase"
+	case kdfKeyFile:
+		return "a key file"
+	}
+	return kdf
+}
+
+// FileStore keeps credentials in a single file encrypted with AES-256-GCM.
+// The key is derived either from a passphrase with scrypt or from a machine
+// key file, the user names are encrypted as well.
+type FileStore struct {
+	path   string
+	kdf    string
+	derive func(salt []byte) ([]byte, error)
+	mu     sync.Mutex
+}
+
+// NewPassphraseStore opens the store at path with a key derived from
+// passphrase, the file is created on the first Set.
+func NewPassphraseStore(path string, passphrase []byte) *FileStore {
+	pass := append([]byte(nil), passphrase...)
+	return &FileStore{path: path, kdf: kdfScrypt, derive: func(salt []byte) ([]byte, error) {
+		return scrypt.Key(pass, salt, 1<<15, 8, 1, 32)
+	}}
+}
+
+// NewKeyFileStore opens the store at path with a key derived from keyFile,
+// which is created with random content if it does not exist. Anyone able to
+// read the key file can read the store.
+func NewKeyFileStore(path, keyFile string) (*FileStore, error) {
+	secret, err := os.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		err = writeNewFile(keyFile, secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("key file %s is too short", keyFile)
+	}
+	return &FileStore{path: path, kdf: kdfKeyFile, derive: func(salt []byte) ([]byte, error) {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(salt)
+		return mac.Sum(nil), nil
+	}}, nil
+}
+
+func writeNewFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (f *FileStore) Get(user string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries, _, err := f.load()
+	if err != nil {
+		return "", err
+	}
+	pass, ok := entries[user]
+	if !ok {
+		return "", ErrCredentialNotFound
+	}
+	return pass, nil
+}
+
+func (f *FileStore) Set(user, password string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries, salt, err := f.load()
+	if err != nil {
+		return err
+	}
+	entries[user] = password
+	return f.save(entries, salt)
+}
+
+func (f *FileStore) Delete(user string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries, salt, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[user]; !ok {
+		return nil
+	}
+	delete(entries, user)
+	return f.save(entries, salt)
+}
+
+// aead derives the key for salt, it is wiped once the cipher is set up.
+func (f *FileStore) aead(salt []byte) (cipher.AEAD, error) {
+	key, err := f.derive(salt)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// load decrypts the store, a missing file is an empty store with a fresh
+// salt.
+func (f *FileStore) load() (map[string]string, []byte, error) {
+	entries := make(map[string]string)
+	buf, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+		return entries, salt, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var file credentialFile
+	if err := json.Unmarshal(buf, &file); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	if file.Version != credentialFileVersion {
+		return nil, nil, fmt.Errorf("%s: unsupported version %d", f.path, file.Version)
+	}
+	if file.KDF != f.kdf {
+		return nil, nil, fmt.Errorf("%s is protected by %s, not %s", f.path, kdfName(file.KDF), kdfName(f.kdf))
+	}
+	aead, err := f.aead(file.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(file.Data) < aead.NonceSize() {
+		return nil, nil, fmt.Errorf("%s: truncated data", f.path)
+	}
+	nonce, sealed := file.Data[:aead.NonceSize()], file.Data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, []byte(credentialAAD))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", f.path, ErrCredentialKey)
+	}
+	defer clear(plain)
+	if err := json.Unmarshal(plain, &entries); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	return entries, file.Salt, nil
+}
+
+// save seals entries with a new nonce and replaces the file atomically.
+func (f *FileStore) save(entries map[string]string, salt []byte) error {
+	aead, err := f.aead(salt)
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	defer clear(plain)
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(credentialFile{
+		Version: credentialFileVersion,
+		KDF:     f.kdf,
+		Salt:    salt,
+		Data:    aead.Seal(nonce, nonce, plain, []byte(credentialAAD)),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
@@ -1,27 +1,115 @@
 package rjsocks
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 )
 
+// Clock is the time source of a Crontab, tests substitute a fake one.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call scheduled by a Clock.
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
 type CronItem struct {
-	Func2run   func()
-	LastAccess time.Time
-	Interval   time.Duration
+	Func2run func()
+	Interval time.Duration
+	// Jitter delays every run by a random duration in [0, Jitter).
+	Jitter time.Duration
+	// OneShot items run once, Interval after being registered, and are
+	// removed afterwards.
+	OneShot bool
 }
 
 func NewCronItem(f func(), interval time.Duration) *CronItem {
 	return &CronItem{Func2run: f, Interval: interval}
 }
 
+func NewOneShotCronItem(f func(), delay time.Duration) *CronItem {
+	return &CronItem{Func2run: f, Interval: delay, OneShot: true}
+}
+
+// CronJob describes a registered item, as returned by Crontab.Jobs.
+type CronJob struct {
+	Name     string
+	Interval time.Duration
+	OneShot  bool
+	LastRun  time.Time
+	NextRun  time.Time
+	Runs     int
+	// LastErr holds the panic of the last run, if any.
+	LastErr error
+}
+
+type cronJob struct {
+	item    *CronItem
+	timer   Timer
+	gen     uint64 // invalidates timers of previous schedules
+	lastRun time.Time
+	nextRun time.Time
+	runs    int
+	lastErr error
+}
+
+// Crontab runs items periodically, each on its own timer. Items only fire
+// while Run is active.
 type Crontab struct {
-	m        sync.Map
-	isClosed bool
+	clock     Clock
+	mu        sync.Mutex
+	jobs      map[string]*cronJob
+	running   bool
+	closed    bool
+	done      chan struct{}
+	onError   func(name string, err error)
+	logger    *slog.Logger
+	closeOnce sync.Once
+	// calls tracks the items running, Close waits for them.
+	calls sync.WaitGroup
 }
 
 func NewCrontab() *Crontab {
-	return new(Crontab)
+	return NewClockCrontab(realClock{})
+}
+
+// NewClockCrontab returns a Crontab driven by clock.
+func NewClockCrontab(clock Clock) *Crontab {
+	return &Crontab{
+		clock:  clock,
+		jobs:   make(map[string]*cronJob),
+		done:   make(chan struct{}),
+		logger: defaultLogger(),
+	}
+}
+
+// SetErrorHandler sets the callback receiving recovered panics of items. By
+// default they are logged.
+func (c *Crontab) SetErrorHandler(f func(name string, err error)) {
+	c.mu.Lock()
+	c.onError = f
+	c.mu.Unlock()
+}
+
+// SetLogger sets where panics are reported when no error handler is set.
+func (c *Crontab) SetLogger(l *slog.Logger) {
+	c.mu.Lock()
+	c.logger = redactLogger(l)
+	c.mu.Unlock()
 }
 
 func (c *Crontab) Register(name string, item *CronItem) {
@@ -30,56 +118,178 @@ func (c *Crontab) Register(name string, item *CronItem) {
 	}
 }
 
+// ForceRegister adds item, replacing any item of the same name. It first
+// runs Interval from now.
 func (c *Crontab) ForceRegister(name string, item *CronItem) {
-	item.LastAccess = time.Now()
-	c.m.Store(name, item)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	if old, ok := c.jobs[name]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+	j := &cronJob{item: item}
+	c.jobs[name] = j
+	c.schedule(name, j, c.clock.Now())
 }
 
 func (c *Crontab) Exist(name string) bool {
-	_, ok := c.m.Load(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.jobs[name]
 	return ok
 }
 
 func (c *Crontab) Delete(name string) bool {
-	if c.Exist(name) {
-		c.m.Delete(name)
-		return true
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	j, ok := c.jobs[name]
+	if !ok {
+		return false
 	}
-	return false
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+	delete(c.jobs, name)
+	return true
 }
 
+// UpdateLastAccess postpones the next run of name to Interval after tm.
 func (c *Crontab) UpdateLastAccess(name string, tm time.Time) bool {
-	if val, ok := c.m.Load(name); ok {
-		item := val.(*CronItem)
-		item.LastAccess = tm
-		return true
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	j, ok := c.jobs[name]
+	if ok {
+		c.schedule(name, j, tm)
+	}
+	return ok
+}
+
+// Jobs lists the registered items sorted by name.
+func (c *Crontab) Jobs() []CronJob {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make([]CronJob, 0, len(c.jobs))
+	for name, j := range c.jobs {
+		ret = append(ret, CronJob{
+			Name:     name,
+			Interval: j.item.Interval,
+			OneShot:  j.item.OneShot,
+			LastRun:  j.lastRun,
+			NextRun:  j.nextRun,
+			Runs:     j.runs,
+			LastErr:  j.lastErr,
+		})
+	}
+	sort.Slice(ret, func(a, b int) bool { return ret[a].Name < ret[b].Name })
+	return ret
+}
+
+// schedule computes the next run of j counting from and arms its timer.
+// c.mu must be held.
+func (c *Crontab) schedule(name string, j *cronJob, from time.Time) {
+	j.nextRun = from.Add(j.item.Interval)
+	if j.item.Jitter > 0 {
+		j.nextRun = j.nextRun.Add(time.Duration(rand.Int63n(int64(j.item.Jitter))))
+	}
+	c.arm(name, j)
+}
+
+// arm replaces the timer of j by one firing at j.nextRun, provided the
+// crontab is running. c.mu must be held.
+func (c *Crontab) arm(name string, j *cronJob) {
+	if j.timer != nil {
+		j.timer.Stop()
+		j.timer = nil
 	}
-	return false
+	j.gen++
+	if !c.running {
+		return
+	}
+	gen := j.gen
+	j.timer = c.clock.AfterFunc(j.nextRun.Sub(c.clock.Now()), func() { c.fire(name, gen) })
+}
+
+func (c *Crontab) fire(name string, gen uint64) {
+	c.mu.Lock()
+	j, ok := c.jobs[name]
+	if !ok || j.gen != gen || !c.running {
+		c.mu.Unlock()
+		return
+	}
+	now := c.clock.Now()
+	j.lastRun = now
+	j.runs++
+	if j.item.OneShot {
+		delete(c.jobs, name)
+	} else {
+		c.schedule(name, j, now)
+	}
+	c.calls.Add(1)
+	c.mu.Unlock()
+	go func() {
+		defer c.calls.Done()
+		c.call(name, j)
+	}()
 }
 
-func (c *Crontab) Run() error {
-	for t := range time.Tick(1 * time.Second) {
-		if c.isClosed {
-			break
+// call runs the item, turning a panic into an error for the error handler.
+func (c *Crontab) call(name string, j *cronJob) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
 		}
-		rangeFunc := func(n, i interface{}) bool {
-			name := n.(string)
-			item := i.(*CronItem)
-			if t.Sub(item.LastAccess) >= item.Interval {
-				c.UpdateLastAccess(name, time.Now())
-				go item.Func2run()
-			}
-			return true
+		err := fmt.Errorf("cron item %s panicked: %v", name, r)
+		c.mu.Lock()
+		j.lastErr = err
+		onError, logger := c.onError, c.logger
+		c.mu.Unlock()
+		if onError != nil {
+			onError(name, err)
+		} else {
+			logger.Error("cron item panicked", "job", name, "err", err)
 		}
-		c.m.Range(rangeFunc)
+	}()
+	j.item.Func2run()
+}
+
+// Run arms the timers of all items and blocks until ctx is cancelled or
+// Close is called. The crontab is closed when Run returns.
+func (c *Crontab) Run(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.running = true
+	for name, j := range c.jobs {
+		c.arm(name, j)
+	}
+	c.mu.Unlock()
+	defer c.Close()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return nil
 	}
-	return nil
 }
 
+// Close stops all timers and waits for the items still running, so it must
+// not be called from an item.
 func (c *Crontab) Close() {
-	c.m.Range(func(key, val interface{}) bool {
-		c.m.Delete(key)
-		return true
-	})
-	c.isClosed = true
+	c.mu.Lock()
+	for name, j := range c.jobs {
+		if j.timer != nil {
+			j.timer.Stop()
+		}
+		delete(c.jobs, name)
+	}
+	c.running = false
+	c.closed = true
+	c.mu.Unlock()
+	c.closeOnce.Do(func() { close(c.done) })
+	c.calls.Wait()
 }
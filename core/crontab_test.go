@@ -0,0 +1,280 @@
+package rjsocks
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when told to, timers fire from Advance.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	f     func()
+	done  bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	pending := !t.done
+	t.done = true
+	return pending
+}
+
+// pending counts the timers that have yet to fire.
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if !t.done {
+			n++
+		}
+	}
+	return n
+}
+
+// Advance moves the clock by d and fires the timers that became due, in
+// order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if !t.done && !t.when.After(c.now) {
+			t.done = true
+			due = append(due, t)
+		}
+	}
+	sort.Slice(due, func(a, b int) bool { return due[a].when.Before(due[b].when) })
+	c.mu.Unlock()
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// runCrontab runs c until the test ends and returns once its timers are
+// armed. Run returns nil if the test closed c itself.
+func runCrontab(t *testing.T, c *Crontab, clock *fakeClock, timers int) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil && err != context.Canceled {
+			t.Errorf("Run returned %v", err)
+		}
+	})
+	deadline := time.Now().Add(time.Second)
+	for clock.pending() < timers {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers armed, want %d", clock.pending(), timers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func expectRun(t *testing.T, ran <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("item did not run")
+	}
+}
+
+func expectNoRun(t *testing.T, ran <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ran:
+		t.Fatal("item ran early")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestCrontabPeriodic(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	c := NewClockCrontab(clock)
+	ran := make(chan struct{}, 4)
+	c.ForceRegister("echo", NewCronItem(func() { ran <- struct{}{} }, 10*time.Second))
+	runCrontab(t, c, clock, 1)
+
+	clock.Advance(9 * time.Second)
+	expectNoRun(t, ran)
+	clock.Advance(time.Second)
+	expectRun(t, ran)
+	clock.Advance(10 * time.Second)
+	expectRun(t, ran)
+
+	jobs := c.Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("Jobs() = %+v", jobs)
+	}
+	j := jobs[0]
+	if j.Name != "echo" || j.Runs != 2 || !j.LastRun.Equal(start.Add(20*time.Second)) || !j.NextRun.Equal(start.Add(30*time.Second)) {
+		t.Fatalf("Jobs() = %+v", j)
+	}
+}
+
+func TestCrontabUpdateLastAccess(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	c := NewClockCrontab(clock)
+	ran := make(chan struct{}, 4)
+	c.ForceRegister("monitor", NewCronItem(func() { ran <- struct{}{} }, 40*time.Second))
+	runCrontab(t, c, clock, 1)
+
+	clock.Advance(30 * time.Second)
+	c.UpdateLastAccess("monitor", clock.Now())
+	clock.Advance(30 * time.Second)
+	expectNoRun(t, ran)
+	if next := c.Jobs()[0].NextRun; !next.Equal(start.Add(70 * time.Second)) {
+		t.Fatalf("next run %v, want %v", next, start.Add(70*time.Second))
+	}
+	clock.Advance(10 * time.Second)
+	expectRun(t, ran)
+}
+
+func TestCrontabOneShot(t *testing.T) {
+	clock := newFakeClock()
+	c := NewClockCrontab(clock)
+	ran := make(chan struct{}, 4)
+	c.ForceRegister("once", NewOneShotCronItem(func() { ran <- struct{}{} }, 5*time.Second))
+	runCrontab(t, c, clock, 1)
+
+	clock.Advance(5 * time.Second)
+	expectRun(t, ran)
+	if jobs := c.Jobs(); len(jobs) != 0 {
+		t.Fatalf("one-shot item still listed: %+v", jobs)
+	}
+	clock.Advance(time.Minute)
+	expectNoRun(t, ran)
+	if c.Exist("once") {
+		t.Fatal("one-shot item still registered")
+	}
+}
+
+func TestCrontabJitter(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	c := NewClockCrontab(clock)
+	ran := make(chan struct{}, 4)
+	c.ForceRegister("jittered", &CronItem{Func2run: func() { ran <- struct{}{} }, Interval: 10 * time.Second, Jitter: 4 * time.Second})
+	runCrontab(t, c, clock, 1)
+
+	next := c.Jobs()[0].NextRun
+	if next.Before(start.Add(10*time.Second)) || !next.Before(start.Add(14*time.Second)) {
+		t.Fatalf("next run %v outside [10s, 14s)", next.Sub(start))
+	}
+	clock.Advance(next.Sub(start) - time.Nanosecond)
+	expectNoRun(t, ran)
+	clock.Advance(time.Nanosecond)
+	expectRun(t, ran)
+	last, next2 := c.Jobs()[0].LastRun, c.Jobs()[0].NextRun
+	if d := next2.Sub(last); d < 10*time.Second || d >= 14*time.Second {
+		t.Fatalf("second delay %v outside [10s, 14s)", d)
+	}
+}
+
+func TestCrontabPanicRecovery(t *testing.T) {
+	clock := newFakeClock()
+	c := NewClockCrontab(clock)
+	type report struct {
+		name string
+		err  error
+	}
+	reports := make(chan report, 4)
+	c.SetErrorHandler(func(name string, err error) { reports <- report{name, err} })
+	c.ForceRegister("boom", NewCronItem(func() { panic("kaboom") }, time.Second))
+	runCrontab(t, c, clock, 1)
+
+	for i := 1; i <= 2; i++ {
+		clock.Advance(time.Second)
+		select {
+		case r := <-reports:
+			if r.name != "boom" || !strings.Contains(r.err.Error(), "kaboom") {
+				t.Fatalf("reported %q: %v", r.name, r.err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("panic not reported")
+		}
+	}
+	j := c.Jobs()[0]
+	if j.Runs != 2 || j.LastErr == nil {
+		t.Fatalf("Jobs() = %+v, want 2 runs and the panic", j)
+	}
+}
+
+func TestCrontabCloseWaitsForItems(t *testing.T) {
+	clock := newFakeClock()
+	c := NewClockCrontab(clock)
+	started, release := make(chan struct{}), make(chan struct{})
+	c.ForceRegister("slow", NewOneShotCronItem(func() {
+		close(started)
+		<-release
+	}, time.Second))
+	runCrontab(t, c, clock, 1)
+
+	clock.Advance(time.Second)
+	<-started
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while an item was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+}
+
+func TestCrontabIdleUntilRun(t *testing.T) {
+	clock := newFakeClock()
+	c := NewClockCrontab(clock)
+	c.ForceRegister("echo", NewCronItem(func() { t.Error("item ran before Run") }, time.Second))
+	clock.Advance(time.Minute)
+	if n := clock.pending(); n != 0 {
+		t.Fatalf("%d timers armed before Run", n)
+	}
+	c.Close()
+	if c.Exist("echo") {
+		t.Fatal("Close kept the item")
+	}
+}
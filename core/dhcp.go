@@ -0,0 +1,437 @@
+package rjsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// RenewDHCP selects the built-in DHCP client, see Service.EnableDHCP.
+const RenewDHCP = "dhcp"
+
+const (
+	dhcpClientPort = 68
+	dhcpServerPort = 67
+	// dhcpRetryInterval is how long a failed renewal waits for another try.
+	dhcpRetryInterval = time.Minute
+)
+
+var (
+	ErrDHCPTimeout = errors.New("dhcp: no answer from server")
+	ErrDHCPNak     = errors.New("dhcp: request declined by server")
+)
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// Lease is an IPv4 configuration handed out by a DHCP server.
+type Lease struct {
+	IP        net.IP
+	Mask      net.IPMask
+	Gateway   net.IP
+	DNS       []net.IP
+	Server    net.IP
+	ServerMAC net.HardwareAddr
+	Obtained  time.Time
+	// Duration is the lease time, T1 and T2 the renewal and rebinding
+	// times, all relative to Obtained.
+	Duration, T1, T2 time.Duration
+}
+
+// IPInfo returns the lease as reported to the authenticator.
+func (l *Lease) IPInfo() *IPInfo {
+	info := &IPInfo{DHCP: true, IP: l.IP, Mask: l.Mask, Gateway: l.Gateway}
+	if len(l.DNS) > 0 {
+		info.DNS = l.DNS[0]
+	}
+	return info
+}
+
+func (l *Lease) String() string {
+	return fmt.Sprintf("%s/%d via %s from %s for %v", l.IP, maskBits(l.Mask), l.Gateway, l.Server, l.Duration)
+}
+
+func maskBits(m net.IPMask) int {
+	ones, _ := m.Size()
+	return ones
+}
+
+// Configurator applies leases to the system. old is the lease being
+// replaced, if any; a nil lease asks for old to be removed.
+type Configurator interface {
+	Apply(ctx context.Context, adapter string, old, lease *Lease) error
+}
+
+// ConfiguratorFunc lets a callback act as Configurator.
+type ConfiguratorFunc func(ctx context.Context, adapter string, old, lease *Lease) error
+
+func (f ConfiguratorFunc) Apply(ctx context.Context, adapter string, old, lease *Lease) error {
+	return f(ctx, adapter, old, lease)
+}
+
+// leaser is implemented by Renewers that hold the resulting lease.
+type leaser interface {
+	Lease() *Lease
+}
+
+type dhcpReply struct {
+	msg *layers.DHCPv4
+	src net.HardwareAddr
+}
+
+// DHCPClient obtains and renews an IPv4 lease over raw frames, for targets
+// that have no DHCP client of their own. It implements Renewer.
+type DHCPClient struct {
+	// Timeout is how long the first attempt of an exchange waits for an
+	// answer, it doubles on every retry.
+	Timeout  time.Duration
+	Retries  int
+	Hostname string
+
+	transport Transport
+	mac       net.HardwareAddr
+	conf      Configurator
+	replies   chan dhcpReply
+	xchg      sync.Mutex // serializes exchanges
+
+	mu     sync.Mutex // guards the fields below
+	lease  *Lease
+	logger *slog.Logger
+}
+
+// NewDHCPClient opens dev for DHCP replies addressed to mac. conf applies
+// the leases, nil only keeps them for the authenticator.
+func NewDHCPClient(dev *NetworkDev, mac net.HardwareAddr, conf Configurator) (*DHCPClient, error) {
+	t, err := openDHCPTransport(dev.Name)
+	if err != nil {
+		return nil, err
+	}
+	return NewTransportDHCPClient(t, mac, conf), nil
+}
+
+// NewTransportDHCPClient builds a DHCPClient exchanging frames through t.
+func NewTransportDHCPClient(t Transport, mac net.HardwareAddr, conf Configurator) *DHCPClient {
+	c := &DHCPClient{
+		Timeout:   4 * time.Second,
+		Retries:   3,
+		transport: t,
+		mac:       mac,
+		conf:      conf,
+		replies:   make(chan dhcpReply, 16),
+		logger:    defaultLogger(),
+	}
+	go c.read()
+	return c
+}
+
+// read passes on the replies addressed to c until the transport is closed.
+func (c *DHCPClient) read() {
+	defer close(c.replies)
+	for {
+		data, err := c.transport.ReadFrame()
+		if err != nil {
+			return
+		}
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		l := packet.Layer(layers.LayerTypeDHCPv4)
+		if l == nil {
+			continue
+		}
+		msg := l.(*layers.DHCPv4)
+		if msg.Operation != layers.DHCPOpReply || !bytes.Equal(msg.ClientHWAddr, c.mac) {
+			continue
+		}
+		eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		select {
+		case c.replies <- dhcpReply{msg: msg, src: eth.SrcMAC}:
+		default:
+			// nobody is waiting, the reply is stale
+		}
+	}
+}
+
+func (c *DHCPClient) SetLogger(l *slog.Logger) {
+	c.mu.Lock()
+	c.logger = redactLogger(l)
+	c.mu.Unlock()
+}
+
+// Lease returns the current lease, nil before the first one.
+func (c *DHCPClient) Lease() *Lease {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lease
+}
+
+func (c *DHCPClient) Method() string {
+	return RenewDHCP
+}
+
+// Renew extends the current lease, or obtains a new one if there is none or
+// it cannot be extended. The result is applied through the Configurator.
+func (c *DHCPClient) Renew(ctx context.Context, adapter string) error {
+	c.xchg.Lock()
+	defer c.xchg.Unlock()
+	old := c.Lease()
+	now := time.Now()
+	var lease *Lease
+	var err error
+	if old != nil && now.Before(old.Obtained.Add(old.Duration)) {
+		// renewing talks to the server that granted the lease, once T2
+		// passed any server may answer (RFC 2131 4.4.5)
+		rebinding := !now.Before(old.Obtained.Add(old.T2))
+		lease, err = c.extend(ctx, old, rebinding)
+		if err != nil && !errors.Is(err, ErrDHCPNak) {
+			return err
+		}
+	}
+	if lease == nil {
+		if lease, err = c.discover(ctx); err != nil {
+			return err
+		}
+	}
+	if c.conf != nil {
+		if err := c.conf.Apply(ctx, adapter, old, lease); err != nil {
+			return fmt.Errorf("applying dhcp lease: %w", err)
+		}
+	}
+	c.mu.Lock()
+	c.lease = lease
+	logger := c.logger
+	c.mu.Unlock()
+	logger.Info("dhcp lease bound", "adapter", adapter, "lease", lease.String())
+	return nil
+}
+
+// Release gives the lease back to its server and removes it through the
+// Configurator.
+func (c *DHCPClient) Release(ctx context.Context, adapter string) error {
+	c.xchg.Lock()
+	defer c.xchg.Unlock()
+	old := c.Lease()
+	if old == nil {
+		return nil
+	}
+	msg := c.message(layers.DHCPMsgTypeRelease, rand.Uint32(), old.IP,
+		layers.NewDHCPOption(layers.DHCPOptServerID, old.Server.To4()))
+	frame, err := c.frame(msg, old.IP, old.Server, old.ServerMAC)
+	if err != nil {
+		return err
+	}
+	if err := c.transport.WriteFrame(frame); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.lease = nil
+	c.mu.Unlock()
+	if c.conf != nil {
+		return c.conf.Apply(ctx, adapter, old, nil)
+	}
+	return nil
+}
+
+// Close releases the transport, the lease itself is left in place.
+func (c *DHCPClient) Close() error {
+	return c.transport.Close()
+}
+
+func (c *DHCPClient) discover(ctx context.Context) (*Lease, error) {
+	xid := rand.Uint32()
+	offer, err := c.transact(ctx, c.message(layers.DHCPMsgTypeDiscover, xid, nil),
+		net.IPv4zero, net.IPv4bcast, broadcastMAC, layers.DHCPMsgTypeOffer)
+	if err != nil {
+		return nil, err
+	}
+	server := dhcpOption(offer.msg, layers.DHCPOptServerID)
+	if len(server) != net.IPv4len {
+		return nil, errors.New("dhcp: offer without server identifier")
+	}
+	req := c.message(layers.DHCPMsgTypeRequest, xid, nil,
+		layers.NewDHCPOption(layers.DHCPOptRequestIP, offer.msg.YourClientIP.To4()),
+		layers.NewDHCPOption(layers.DHCPOptServerID, server))
+	ack, err := c.transact(ctx, req, net.IPv4zero, net.IPv4bcast, broadcastMAC, layers.DHCPMsgTypeAck)
+	if err != nil {
+		return nil, err
+	}
+	return newLease(ack, time.Now()), nil
+}
+
+// extend sends a REQUEST for old, unicast to its server or broadcast when
+// rebinding.
+func (c *DHCPClient) extend(ctx context.Context, old *Lease, rebinding bool) (*Lease, error) {
+	dst, dstMAC := old.Server, old.ServerMAC
+	if rebinding {
+		dst, dstMAC = net.IPv4bcast, broadcastMAC
+	}
+	msg := c.message(layers.DHCPMsgTypeRequest, rand.Uint32(), old.IP)
+	ack, err := c.transact(ctx, msg, old.IP, dst, dstMAC, layers.DHCPMsgTypeAck)
+	if err != nil {
+		return nil, err
+	}
+	return newLease(ack, time.Now()), nil
+}
+
+// message builds a client message. Without ciaddr the server is asked to
+// broadcast its answer since the client has no address yet.
+func (c *DHCPClient) message(typ layers.DHCPMsgType, xid uint32, ciaddr net.IP, opts ...layers.DHCPOption) *layers.DHCPv4 {
+	msg := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  uint8(len(c.mac)),
+		Xid:          xid,
+		ClientIP:     ciaddr,
+		ClientHWAddr: c.mac,
+	}
+	if ciaddr == nil {
+		msg.Flags = 0x8000
+	}
+	msg.Options = append(msg.Options,
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(typ)}),
+		layers.NewDHCPOption(layers.DHCPOptClientID, append([]byte{byte(layers.LinkTypeEthernet)}, c.mac...)),
+	)
+	if typ != layers.DHCPMsgTypeRelease {
+		msg.Options = append(msg.Options, layers.NewDHCPOption(layers.DHCPOptParamsRequest, []byte{
+			byte(layers.DHCPOptSubnetMask), byte(layers.DHCPOptRouter), byte(layers.DHCPOptDNS),
+			byte(layers.DHCPOptLeaseTime), byte(layers.DHCPOptT1), byte(layers.DHCPOptT2),
+		}))
+		if len(c.Hostname) > 0 {
+			msg.Options = append(msg.Options, layers.NewDHCPOption(layers.DHCPOptHostname, []byte(c.Hostname)))
+		}
+	}
+	msg.Options = append(msg.Options, opts...)
+	return msg
+}
+
+func (c *DHCPClient) frame(msg *layers.DHCPv4, src, dst net.IP, dstMAC net.HardwareAddr) ([]byte, error) {
+	eth := layers.Ethernet{
+		SrcMAC:       c.mac,
+		DstMAC:       dstMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    src.To4(),
+		DstIP:    dst.To4(),
+	}
+	udp := layers.UDP{SrcPort: dhcpClientPort, DstPort: dhcpServerPort}
+	udp.SetNetworkLayerForChecksum(&ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, &eth, &ip, &udp, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// transact sends msg until a reply of the same transaction arrives. A NAK
+// yields ErrDHCPNak, any other type than want is skipped.
+func (c *DHCPClient) transact(ctx context.Context, msg *layers.DHCPv4, src, dst net.IP, dstMAC net.HardwareAddr, want layers.DHCPMsgType) (*dhcpReply, error) {
+	frame, err := c.frame(msg, src, dst, dstMAC)
+	if err != nil {
+		return nil, err
+	}
+	timeout := c.Timeout
+	for attempt := 0; ; attempt++ {
+		if err := c.transport.WriteFrame(frame); err != nil {
+			return nil, err
+		}
+		r, err := c.await(ctx, msg.Xid, want, timeout)
+		if err != ErrDHCPTimeout || attempt >= c.Retries {
+			return r, err
+		}
+		timeout *= 2
+	}
+}
+
+func (c *DHCPClient) await(ctx context.Context, xid uint32, want layers.DHCPMsgType, timeout time.Duration) (*dhcpReply, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, ErrDHCPTimeout
+		case r, ok := <-c.replies:
+			if !ok {
+				return nil, ErrTransportClosed
+			}
+			if r.msg.Xid != xid {
+				continue
+			}
+			typ := dhcpOption(r.msg, layers.DHCPOptMessageType)
+			if len(typ) != 1 {
+				continue
+			}
+			switch layers.DHCPMsgType(typ[0]) {
+			case want:
+				return &r, nil
+			case layers.DHCPMsgTypeNak:
+				return nil, ErrDHCPNak
+			}
+		}
+	}
+}
+
+func dhcpOption(msg *layers.DHCPv4, typ layers.DHCPOpt) []byte {
+	for _, o := range msg.Options {
+		if o.Type == typ {
+			return o.Data
+		}
+	}
+	return nil
+}
+
+func dhcpDuration(msg *layers.DHCPv4, typ layers.DHCPOpt) time.Duration {
+	if v := dhcpOption(msg, typ); len(v) == 4 {
+		return time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	return 0
+}
+
+// newLease reads an ACK, missing timers default to the RFC 2131 fractions
+// of the lease time.
+func newLease(ack *dhcpReply, now time.Time) *Lease {
+	msg := ack.msg
+	lease := &Lease{
+		IP:        msg.YourClientIP.To4(),
+		Server:    net.IP(dhcpOption(msg, layers.DHCPOptServerID)),
+		ServerMAC: ack.src,
+		Obtained:  now,
+		Duration:  dhcpDuration(msg, layers.DHCPOptLeaseTime),
+		T1:        dhcpDuration(msg, layers.DHCPOptT1),
+		T2:        dhcpDuration(msg, layers.DHCPOptT2),
+	}
+	if v := dhcpOption(msg, layers.DHCPOptSubnetMask); len(v) == 4 {
+		lease.Mask = net.IPMask(v)
+	} else {
+		lease.Mask = lease.IP.DefaultMask()
+	}
+	if v := dhcpOption(msg, layers.DHCPOptRouter); len(v) >= 4 {
+		lease.Gateway = net.IP(v[:4])
+	}
+	for v := dhcpOption(msg, layers.DHCPOptDNS); len(v) >= 4; v = v[4:] {
+		lease.DNS = append(lease.DNS, net.IP(v[:4]))
+	}
+	if lease.Duration == 0 {
+		lease.Duration = time.Hour
+	}
+	if lease.T1 == 0 || lease.T1 > lease.Duration {
+		lease.T1 = lease.Duration / 2
+	}
+	if lease.T2 == 0 || lease.T2 > lease.Duration {
+		lease.T2 = lease.Duration * 7 / 8
+	}
+	return lease
+}
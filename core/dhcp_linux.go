@@ -0,0 +1,179 @@
+//go:build linux
+
+package rjsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// dhcpRouteMetric is added to the interface index for the metric of the
+// default routes NetlinkConfigurator installs.
+const dhcpRouteMetric = 1024
+
+// NetlinkConfigurator applies leases with rtnetlink, replacing the address
+// and the default route of the adapter. It needs CAP_NET_ADMIN.
+type NetlinkConfigurator struct {
+	// ResolvConf is rewritten with the lease's name servers, empty leaves
+	// DNS alone.
+	ResolvConf string
+	// Metric is the metric of the default route. Zero picks one per
+	// interface, so sessions on several interfaces each keep their route
+	// instead of replacing each other's.
+	Metric uint32
+}
+
+func NewNetlinkConfigurator() *NetlinkConfigurator {
+	return &NetlinkConfigurator{}
+}
+
+// DefaultConfigurator applies leases of the built-in DHCP client, used by
+// profiles renewing with RenewDHCP.
+func DefaultConfigurator() Configurator {
+	return NewNetlinkConfigurator()
+}
+
+func (n *NetlinkConfigurator) Apply(ctx context.Context, adapter string, old, lease *Lease) error {
+	ifc, err := net.InterfaceByName(adapter)
+	if err != nil {
+		return err
+	}
+	if old != nil && (lease == nil || !old.IP.Equal(lease.IP) || maskBits(old.Mask) != maskBits(lease.Mask)) {
+		err := netlinkRequest(unix.RTM_DELADDR, 0, ifAddrMsg(ifc.Index, old))
+		if err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+			return os.NewSyscallError("rtm_deladdr", err)
+		}
+	}
+	if lease == nil {
+		return nil
+	}
+	if err := netlinkRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, ifAddrMsg(ifc.Index, lease)); err != nil {
+		return os.NewSyscallError("rtm_newaddr", err)
+	}
+	if lease.Gateway != nil {
+		metric := n.Metric
+		if metric == 0 {
+			metric = dhcpRouteMetric + uint32(ifc.Index)
+		}
+		if err := netlinkRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, defaultRouteMsg(ifc.Index, lease.Gateway, metric)); err != nil {
+			return os.NewSyscallError("rtm_newroute", err)
+		}
+	}
+	if len(n.ResolvConf) > 0 && len(lease.DNS) > 0 {
+		var buf bytes.Buffer
+		buf.WriteString("# generated by rjsocks\n")
+		for _, ip := range lease.DNS {
+			fmt.Fprintf(&buf, "nameserver %s\n", ip)
+		}
+		return os.WriteFile(n.ResolvConf, buf.Bytes(), 0644)
+	}
+	return nil
+}
+
+// ifAddrMsg builds an ifaddrmsg for lease, the kernel drops the address on
+// its own once the lease runs out.
+func ifAddrMsg(index int, lease *Lease) []byte {
+	msg := unix.IfAddrmsg{
+		Family:    unix.AF_INET,
+		Prefixlen: uint8(maskBits(lease.Mask)),
+		Scope:     unix.RT_SCOPE_UNIVERSE,
+		Index:     uint32(index),
+	}
+	buf := (*[unix.SizeofIfAddrmsg]byte)(unsafe.Pointer(&msg))[:]
+	ip := lease.IP.To4()
+	bcast := make(net.IP, net.IPv4len)
+	for i := range bcast {
+		bcast[i] = ip[i] | ^lease.Mask[len(lease.Mask)-net.IPv4len+i]
+	}
+	secs := uint32(lease.Duration.Seconds())
+	cache := unix.IfaCacheinfo{Prefered: secs, Valid: secs}
+	buf = appendRtAttr(buf, unix.IFA_LOCAL, ip)
+	buf = appendRtAttr(buf, unix.IFA_ADDRESS, ip)
+	buf = appendRtAttr(buf, unix.IFA_BROADCAST, bcast)
+	buf = appendRtAttr(buf, unix.IFA_CACHEINFO, (*[unix.SizeofIfaCacheinfo]byte)(unsafe.Pointer(&cache))[:])
+	return buf
+}
+
+// defaultRouteMsg builds an rtmsg for the default route via gateway. The
+// kernel only replaces a default route of the same metric.
+func defaultRouteMsg(index int, gateway net.IP, metric uint32) []byte {
+	msg := unix.RtMsg{
+		Family:   unix.AF_INET,
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: unix.RTPROT_DHCP,
+		Scope:    unix.RT_SCOPE_UNIVERSE,
+		Type:     unix.RTN_UNICAST,
+	}
+	buf := (*[unix.SizeofRtMsg]byte)(unsafe.Pointer(&msg))[:]
+	oif, prio := make([]byte, 4), make([]byte, 4)
+	binary.NativeEndian.PutUint32(oif, uint32(index))
+	binary.NativeEndian.PutUint32(prio, metric)
+	buf = appendRtAttr(buf, unix.RTA_GATEWAY, gateway.To4())
+	buf = appendRtAttr(buf, unix.RTA_OIF, oif)
+	buf = appendRtAttr(buf, unix.RTA_PRIORITY, prio)
+	return buf
+}
+
+func appendRtAttr(buf []byte, typ uint16, data []byte) []byte {
+	hdr := make([]byte, unix.SizeofRtAttr)
+	binary.NativeEndian.PutUint16(hdr[0:2], uint16(unix.SizeofRtAttr+len(data)))
+	binary.NativeEndian.PutUint16(hdr[2:4], typ)
+	buf = append(append(buf, hdr...), data...)
+	for len(buf)%unix.NLMSG_ALIGNTO != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// netlinkRequest sends one rtnetlink request and waits for its ack.
+func netlinkRequest(typ uint16, flags uint16, body []byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], typ)
+	binary.NativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags)
+	binary.NativeEndian.PutUint32(msg[8:12], 1)
+	msg = append(msg, body...)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		for b := buf[:n]; len(b) >= unix.SizeofNlMsghdr; {
+			l := int(binary.NativeEndian.Uint32(b[0:4]))
+			if l < unix.SizeofNlMsghdr || l > len(b) {
+				return errors.New("malformed netlink message")
+			}
+			if binary.NativeEndian.Uint16(b[4:6]) == unix.NLMSG_ERROR && l >= unix.SizeofNlMsghdr+4 {
+				if errno := int32(binary.NativeEndian.Uint32(b[16:20])); errno != 0 {
+					return unix.Errno(-errno)
+				}
+				return nil
+			}
+			l = (l + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+			if l > len(b) {
+				break
+			}
+			b = b[l:]
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package rjsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var testServerMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0xfe}
+
+// dhcpRequest is a client message as seen by the fake server.
+type dhcpRequest struct {
+	typ            layers.DHCPMsgType
+	ciaddr, reqIP  net.IP
+	dst            net.IP
+	dstMAC         net.HardwareAddr
+	broadcastReply bool
+}
+
+// fakeDHCPServer hands out next to whoever asks, and declines requests
+// while nak is set.
+type fakeDHCPServer struct {
+	t    *testing.T
+	tr   Transport
+	seen chan dhcpRequest
+
+	mu   sync.Mutex
+	next net.IP
+	nak  bool
+}
+
+func newFakeDHCPServer(t *testing.T) (*DHCPClient, *fakeDHCPServer) {
+	client, server := NewPipe()
+	c := NewTransportDHCPClient(client, testHostMAC, nil)
+	c.Timeout, c.Retries = time.Second, 0
+	t.Cleanup(func() { c.Close() })
+	s := &fakeDHCPServer{t: t, tr: server, seen: make(chan dhcpRequest, 16), next: net.IPv4(10, 0, 0, 2).To4()}
+	go s.serve()
+	return c, s
+}
+
+func (s *fakeDHCPServer) set(next net.IP, nak bool) {
+	s.mu.Lock()
+	s.next, s.nak = next.To4(), nak
+	s.mu.Unlock()
+}
+
+func (s *fakeDHCPServer) serve() {
+	for {
+		data, err := s.tr.ReadFrame()
+		if err != nil {
+			return
+		}
+		p := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		msg, _ := p.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+		if msg == nil {
+			continue
+		}
+		eth := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		req := dhcpRequest{
+			typ:            layers.DHCPMsgType(dhcpOption(msg, layers.DHCPOptMessageType)[0]),
+			ciaddr:         msg.ClientIP,
+			reqIP:          net.IP(dhcpOption(msg, layers.DHCPOptRequestIP)),
+			dst:            ip.DstIP,
+			dstMAC:         eth.DstMAC,
+			broadcastReply: msg.Flags&0x8000 != 0,
+		}
+		s.seen <- req
+		s.mu.Lock()
+		next, nak := s.next, s.nak
+		s.mu.Unlock()
+		switch {
+		case req.typ == layers.DHCPMsgTypeDiscover:
+			s.reply(msg, layers.DHCPMsgTypeOffer, next)
+		case req.typ == layers.DHCPMsgTypeRequest && nak:
+			s.reply(msg, layers.DHCPMsgTypeNak, nil)
+		case req.typ == layers.DHCPMsgTypeRequest:
+			yiaddr := req.reqIP
+			if len(yiaddr) == 0 {
+				yiaddr = req.ciaddr
+			}
+			s.reply(msg, layers.DHCPMsgTypeAck, yiaddr)
+		}
+	}
+}
+
+func (s *fakeDHCPServer) reply(req *layers.DHCPv4, typ layers.DHCPMsgType, yiaddr net.IP) {
+	msg := &layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          req.Xid,
+		Flags:        req.Flags,
+		YourClientIP: yiaddr,
+		ClientHWAddr: req.ClientHWAddr,
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(typ)}),
+			layers.NewDHCPOption(layers.DHCPOptServerID, []byte{10, 0, 0, 1}),
+		},
+	}
+	if typ != layers.DHCPMsgTypeNak {
+		msg.Options = append(msg.Options,
+			layers.NewDHCPOption(layers.DHCPOptSubnetMask, []byte{255, 255, 255, 0}),
+			layers.NewDHCPOption(layers.DHCPOptRouter, []byte{10, 0, 0, 1}),
+			layers.NewDHCPOption(layers.DHCPOptDNS, []byte{10, 0, 0, 53}),
+			layers.NewDHCPOption(layers.DHCPOptLeaseTime, []byte{0, 0, 0x0e, 0x10}),
+		)
+	}
+	eth := layers.Ethernet{SrcMAC: testServerMAC, DstMAC: broadcastMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 1).To4(), DstIP: net.IPv4bcast.To4()}
+	udp := layers.UDP{SrcPort: dhcpServerPort, DstPort: dhcpClientPort}
+	udp.SetNetworkLayerForChecksum(&ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, &eth, &ip, &udp, msg); err != nil {
+		s.t.Error(err)
+		return
+	}
+	s.tr.WriteFrame(buf.Bytes())
+}
+
+// expect checks the next client message.
+func (s *fakeDHCPServer) expect(typ layers.DHCPMsgType, ciaddr net.IP, dstMAC net.HardwareAddr) dhcpRequest {
+	s.t.Helper()
+	select {
+	case req := <-s.seen:
+		if req.typ != typ || !req.ciaddr.Equal(ciaddr) || req.dstMAC.String() != dstMAC.String() {
+			s.t.Fatalf("got %v ciaddr %v to %v, want %v ciaddr %v to %v", req.typ, req.ciaddr, req.dstMAC, typ, ciaddr, dstMAC)
+		}
+		return req
+	default:
+		s.t.Fatalf("no %v sent", typ)
+	}
+	return dhcpRequest{}
+}
+
+func TestDHCPClientDiscover(t *testing.T) {
+	c, s := newFakeDHCPServer(t)
+	if err := c.Renew(context.Background(), "test0"); err != nil {
+		t.Fatal(err)
+	}
+	if req := s.expect(layers.DHCPMsgTypeDiscover, net.IPv4zero, broadcastMAC); !req.broadcastReply {
+		t.Error("discover without the broadcast flag")
+	}
+	if req := s.expect(layers.DHCPMsgTypeRequest, net.IPv4zero, broadcastMAC); !req.reqIP.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("request for %v", req.reqIP)
+	}
+	l := c.Lease()
+	if l == nil || !l.IP.Equal(net.IPv4(10, 0, 0, 2)) || maskBits(l.Mask) != 24 || !l.Gateway.Equal(net.IPv4(10, 0, 0, 1)) ||
+		len(l.DNS) != 1 || !l.Server.Equal(net.IPv4(10, 0, 0, 1)) || l.ServerMAC.String() != testServerMAC.String() {
+		t.Fatalf("lease %v", l)
+	}
+	if l.Duration != time.Hour || l.T1 != 30*time.Minute || l.T2 != 52*time.Minute+30*time.Second {
+		t.Fatalf("lease times %v %v %v", l.Duration, l.T1, l.T2)
+	}
+}
+
+func TestDHCPClientRenewRebind(t *testing.T) {
+	var applied []*Lease
+	client, server := NewPipe()
+	c := NewTransportDHCPClient(client, testHostMAC, ConfiguratorFunc(func(_ context.Context, adapter string, old, lease *Lease) error {
+		if adapter != "test0" {
+			t.Errorf("applied to %s", adapter)
+		}
+		if len(applied) > 0 && old != applied[len(applied)-1] {
+			t.Errorf("old lease %v, want %v", old, applied[len(applied)-1])
+		}
+		applied = append(applied, lease)
+		return nil
+	}))
+	c.Timeout, c.Retries = time.Second, 0
+	defer c.Close()
+	s := &fakeDHCPServer{t: t, tr: server, seen: make(chan dhcpRequest, 16), next: net.IPv4(10, 0, 0, 2).To4()}
+	go s.serve()
+	ctx := context.Background()
+	if err := c.Renew(ctx, "test0"); err != nil {
+		t.Fatal(err)
+	}
+	s.expect(layers.DHCPMsgTypeDiscover, net.IPv4zero, broadcastMAC)
+	s.expect(layers.DHCPMsgTypeRequest, net.IPv4zero, broadcastMAC)
+
+	// renewing asks the server that granted the lease
+	if err := c.Renew(ctx, "test0"); err != nil {
+		t.Fatal(err)
+	}
+	if req := s.expect(layers.DHCPMsgTypeRequest, net.IPv4(10, 0, 0, 2), testServerMAC); !req.dst.Equal(net.IPv4(10, 0, 0, 1)) || req.broadcastReply {
+		t.Fatalf("renewal sent to %v, broadcast reply %v", req.dst, req.broadcastReply)
+	}
+
+	// past T2 any server may answer
+	c.mu.Lock()
+	c.lease.Obtained = time.Now().Add(-c.lease.T2 - time.Second)
+	c.mu.Unlock()
+	if err := c.Renew(ctx, "test0"); err != nil {
+		t.Fatal(err)
+	}
+	if req := s.expect(layers.DHCPMsgTypeRequest, net.IPv4(10, 0, 0, 2), broadcastMAC); !req.dst.Equal(net.IPv4bcast) {
+		t.Fatalf("rebinding sent to %v", req.dst)
+	}
+
+	// an expired lease starts over
+	c.mu.Lock()
+	c.lease.Obtained = time.Now().Add(-c.lease.Duration)
+	c.mu.Unlock()
+	if err := c.Renew(ctx, "test0"); err != nil {
+		t.Fatal(err)
+	}
+	s.expect(layers.DHCPMsgTypeDiscover, net.IPv4zero, broadcastMAC)
+	s.expect(layers.DHCPMsgTypeRequest, net.IPv4zero, broadcastMAC)
+	if len(applied) != 4 {
+		t.Fatalf("%d leases applied, want 4", len(applied))
+	}
+}
+
+func TestDHCPClientNak(t *testing.T) {
+	c, s := newFakeDHCPServer(t)
+	ctx := context.Background()
+	if err := c.Renew(ctx, "test0"); err != nil {
+		t.Fatal(err)
+	}
+	s.expect(layers.DHCPMsgTypeDiscover, net.IPv4zero, broadcastMAC)
+	s.expect(layers.DHCPMsgTypeRequest, net.IPv4zero, broadcastMAC)
+
+	// a declined renewal falls back to a fresh discovery
+	s.set(net.IPv4(10, 0, 0, 3), true)
+	if err := c.Renew(ctx, "test0"); !errors.Is(err, ErrDHCPNak) {
+		t.Fatalf("Renew returned %v, want ErrDHCPNak", err)
+	}
+	s.expect(layers.DHCPMsgTypeRequest, net.IPv4(10, 0, 0, 2), testServerMAC)
+	s.expect(layers.DHCPMsgTypeDiscover, net.IPv4zero, broadcastMAC)
+	s.expect(layers.DHCPMsgTypeRequest, net.IPv4zero, broadcastMAC)
+	if l := c.Lease(); !l.IP.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Fatalf("declined renewal replaced the lease with %v", l)
+	}
+
+	s.set(net.IPv4(10, 0, 0, 3), false)
+	c.mu.Lock()
+	c.lease.Obtained = time.Now().Add(-c.lease.Duration)
+	c.mu.Unlock()
+	if err := c.Renew(ctx, "test0"); err != nil {
+		t.Fatal(err)
+	}
+	if l := c.Lease(); !l.IP.Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Fatalf("new lease %v", l)
+	}
+}
+
+func TestDHCPClientTimeout(t *testing.T) {
+	client, server := NewPipe()
+	defer server.Close()
+	c := NewTransportDHCPClient(client, testHostMAC, nil)
+	defer c.Close()
+	c.Timeout, c.Retries = 10*time.Millisecond, 1
+	go func() {
+		for {
+			if _, err := server.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	if err := c.Renew(context.Background(), "test0"); !errors.Is(err, ErrDHCPTimeout) {
+		t.Fatalf("Renew returned %v, want ErrDHCPTimeout", err)
+	}
+}
@@ -0,0 +1,36 @@
+package rjsocks
+
+import (
+	"fmt"
+	"net"
+)
+
+// Dialect is the flavour of 802.1X spoken to the authenticator.
+type Dialect string
+
+const (
+	// DialectRuijie talks to MultiCastAddr and appends the private trailer,
+	// like the official client.
+	DialectRuijie Dialect = "ruijie"
+	// DialectStandard is plain EAP-MD5 on the IEEE PAE group address.
+	DialectStandard Dialect = "standard"
+)
+
+// ParseDialect accepts the dialect names, an empty one means DialectRuijie.
+func ParseDialect(s string) (Dialect, error) {
+	switch Dialect(s) {
+	case "", DialectRuijie:
+		return DialectRuijie, nil
+	case DialectStandard:
+		return DialectStandard, nil
+	}
+	return "", fmt.Errorf("unknown dialect %q", s)
+}
+
+// groupAddr returns where EAPOL-Start goes until an authenticator answers.
+func (d Dialect) groupAddr() net.HardwareAddr {
+	if d == DialectStandard {
+		return paeGroupAddr
+	}
+	return MultiCastAddr
+}
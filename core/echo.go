@@ -0,0 +1,55 @@
+package rjsocks
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// echoInitialNo is the sequence number of the first heartbeat of a session.
+const echoInitialNo = uint32(0x102b)
+
+// echoTemplate is the heartbeat payload, the two counters at [6:10] and
+// [16:20] are filled in by KeepAlive.
+var echoTemplate = [...]byte{0xFF, 0xFF, 0x37, 0x77, 0x7F, 0x9F, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x37, 0x77, 0x7F, 0x9F, 0xFF, 0xFF, 0x00, 0x00, 0xFF, 0xFF, 0x37, 0x77, 0x7F, 0x3F, 0xFF}
+
+// KeepAlive generates the heartbeat payloads of one session. The key comes
+// from the EAP-Success frame and every heartbeat advances the counter.
+type KeepAlive struct {
+	mu  sync.Mutex
+	no  uint32
+	key uint32
+}
+
+func NewKeepAlive(key uint32) *KeepAlive {
+	return &KeepAlive{no: echoInitialNo, key: key}
+}
+
+// Next builds a fresh payload for the current counter and advances it.
+func (k *KeepAlive) Next() []byte {
+	k.mu.Lock()
+	no := k.no
+	k.no++
+	k.mu.Unlock()
+	return echoPayload(no, k.key)
+}
+
+// No returns the counter of the next heartbeat.
+func (k *KeepAlive) No() uint32 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.no
+}
+
+func (k *KeepAlive) Key() uint32 {
+	return k.key
+}
+
+func echoPayload(no, key uint32) []byte {
+	buf := echoTemplate
+	buf1, buf2 := buf[6:10], buf[16:20]
+	binary.BigEndian.PutUint32(buf1, no+key)
+	binary.BigEndian.PutUint32(buf2, no)
+	Symmetric(buf1)
+	Symmetric(buf2)
+	return buf[:]
+}
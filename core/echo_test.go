@@ -0,0 +1,107 @@
+package rjsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// officialEcho is the first heartbeat of the official client for the key
+// 0x540c, as captured in the echo packet the handle used to send.
+var officialEcho = []byte{0xFF, 0xFF, 0x37, 0x77, 0x7F, 0x9F, 0xFF, 0xFF, 0xD9, 0x13, 0xFF, 0xFF, 0x37, 0x77, 0x7F, 0x9F, 0xFF, 0xFF, 0xF7, 0x2B, 0xFF, 0xFF, 0x37, 0x77, 0x7F, 0x3F, 0xFF}
+
+const officialEchoKey = uint32(0x540c)
+
+func TestSymmetric(t *testing.T) {
+	for _, tc := range []struct{ in, out []byte }{
+		{[]byte{0x00, 0x00, 0x00, 0x00}, []byte{0xFF, 0xFF, 0xFF, 0xFF}},
+		{[]byte{0x01, 0x80, 0x0F, 0xF0}, []byte{0x7F, 0xFE, 0x0F, 0xF0}},
+		// the counter and counter+key of officialEcho
+		{[]byte{0x00, 0x00, 0x10, 0x2B}, []byte{0xFF, 0xFF, 0xF7, 0x2B}},
+		{[]byte{0x00, 0x00, 0x64, 0x37}, []byte{0xFF, 0xFF, 0xD9, 0x13}},
+	} {
+		buf := append([]byte(nil), tc.in...)
+		Symmetric(buf)
+		if !bytes.Equal(buf, tc.out) {
+			t.Errorf("Symmetric(% x) = % x, want % x", tc.in, buf, tc.out)
+		}
+		Symmetric(buf)
+		if !bytes.Equal(buf, tc.in) {
+			t.Errorf("Symmetric is not its own inverse for % x", tc.in)
+		}
+	}
+}
+
+// decodeEcho returns the counter and key carried by a heartbeat.
+func decodeEcho(t *testing.T, frame []byte) (no, key uint32) {
+	t.Helper()
+	if len(frame) != len(echoTemplate) {
+		t.Fatalf("heartbeat of %d bytes", len(frame))
+	}
+	buf := append([]byte(nil), frame...)
+	Symmetric(buf[6:10])
+	Symmetric(buf[16:20])
+	no = binary.BigEndian.Uint32(buf[16:20])
+	return no, binary.BigEndian.Uint32(buf[6:10]) - no
+}
+
+func TestKeepAliveOfficialFrame(t *testing.T) {
+	k := NewKeepAlive(officialEchoKey)
+	if k.No() != 0x102b {
+		t.Fatalf("first counter %#x, want 0x102b", k.No())
+	}
+	if frame := k.Next(); !bytes.Equal(frame, officialEcho) {
+		t.Fatalf("first heartbeat\n% x, want\n% x", frame, officialEcho)
+	}
+	frame := k.Next()
+	if no, key := decodeEcho(t, frame); no != 0x102c || key != officialEchoKey {
+		t.Fatalf("second heartbeat carries %#x/%#x", no, key)
+	}
+	for i := range frame {
+		if (i < 6 || i >= 10) && (i < 16 || i >= 20) && frame[i] != officialEcho[i] {
+			t.Fatalf("second heartbeat differs from the template at %d", i)
+		}
+	}
+	if k.No() != 0x102d {
+		t.Fatalf("counter %#x after two heartbeats", k.No())
+	}
+}
+
+func TestKeepAliveIndependent(t *testing.T) {
+	a, b := NewKeepAlive(officialEchoKey), NewKeepAlive(0xdeadbeef)
+	first := a.Next()
+	for i := 0; i < 5; i++ {
+		b.Next()
+	}
+	if !bytes.Equal(first, officialEcho) {
+		t.Fatal("another keep-alive changed a sent heartbeat")
+	}
+	if no, key := decodeEcho(t, a.Next()); no != 0x102c || key != officialEchoKey {
+		t.Fatalf("heartbeat of a carries %#x/%#x", no, key)
+	}
+	if no, key := decodeEcho(t, b.Next()); no != 0x1030 || key != 0xdeadbeef {
+		t.Fatalf("heartbeat of b carries %#x/%#x", no, key)
+	}
+}
+
+func TestSendEchoPkt(t *testing.T) {
+	host, auth := NewPipe()
+	h := NewTransportHandle(host, testHostMAC)
+	defer h.Close()
+	if err := h.SendEchoPkt(NewKeepAlive(officialEchoKey)); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := auth.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eapol := frame[14:18]
+	if eapol[1] != 0xbf || int(binary.BigEndian.Uint16(eapol[2:])) != len(officialEcho) {
+		t.Fatalf("eapol header % x", eapol)
+	}
+	if !bytes.Equal(frame[18:18+len(officialEcho)], officialEcho) || !bytes.Equal(frame[:6], MultiCastAddr) || layers.EthernetType(binary.BigEndian.Uint16(frame[12:])) != layers.EthernetTypeEAPOL {
+		t.Fatalf("echo frame\n% x", frame)
+	}
+}
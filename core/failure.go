@@ -0,0 +1,89 @@
+package rjsocks
+
+import (
+	"errors"
+	"strings"
+)
+
+// Failure reasons reported by Ruijie authenticators. Use errors.Is on the
+// error returned by ParseFailure or Service.LastError to tell them apart.
+var (
+	ErrAuthFailed     = errors.New("authentication failed")
+	ErrBadCredentials = errors.New("wrong username or password")
+	ErrAccountInUse   = errors.New("account is online elsewhere")
+	ErrAccountOverdue = errors.New("account is overdue or disabled")
+	ErrMacBinding     = errors.New("mac address binding mismatch")
+	ErrIPBinding      = errors.New("ip address binding mismatch")
+)
+
+// failureReasons maps phrases of the server message to a reason, the first
+// match wins. The phrases are specific on purpose, a bare 在线 would also
+// match 不在线.
+var failureReasons = []struct {
+	phrases []string
+	reason  error
+}{
+	{[]string{"MAC地址", "MAC绑定", "MAC不匹配", "网卡地址", "网卡绑定"}, ErrMacBinding},
+	{[]string{"IP地址", "IP绑定", "IP不匹配", "IP类型"}, ErrIPBinding},
+	{[]string{"已在线", "已经在线", "同时在线", "在线用户数", "已在别处登录", "已在其他地方登录", "已登录", "已经登录", "重复登录", "已上线"}, ErrAccountInUse},
+	{[]string{"欠费", "余额不足", "已过期", "已到期", "已暂停", "被暂停", "暂停使用", "已禁用", "被禁用", "停机"}, ErrAccountOverdue},
+	{[]string{"密码错误", "密码不正确", "用户名或密码", "用户名错误", "用户不存在", "用户名不存在", "帐号不存在", "账号不存在", "帐户不存在", "账户不存在"}, ErrBadCredentials},
+}
+
+// containsPhrase reports whether msg holds phrase. A phrase starting or
+// ending with a Latin letter must not be glued to other letters or digits
+// there, so that IP is not found in VIP.
+func containsPhrase(msg, phrase string) bool {
+	for i := 0; ; {
+		j := strings.Index(msg[i:], phrase)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(phrase)
+		if !(isWordByte(phrase[0]) && start > 0 && isWordByte(msg[start-1])) &&
+			!(isWordByte(phrase[len(phrase)-1]) && end < len(msg) && isWordByte(msg[end])) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+func isWordByte(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9'
+}
+
+// FailureError is the decoded reason of an EAP-Failure frame.
+type FailureError struct {
+	Reason  error
+	Message string
+}
+
+func (e *FailureError) Error() string {
+	if len(e.Message) == 0 {
+		return e.Reason.Error()
+	}
+	return e.Reason.Error() + ": " + e.Message
+}
+
+func (e *FailureError) Unwrap() error {
+	return e.Reason
+}
+
+// ParseFailure decodes an EAP-Failure frame starting at the EAP header. The
+// server message uses the same layout as the EAP-Success notice. It always
+// returns a *FailureError, ErrAuthFailed being the reason when the message
+// is missing or not recognised.
+func ParseFailure(buf []byte) error {
+	msg, _ := parseNotice(buf)
+	ret := &FailureError{Reason: ErrAuthFailed, Message: msg}
+	upper := strings.ToUpper(msg)
+	for _, r := range failureReasons {
+		for _, phrase := range r.phrases {
+			if containsPhrase(upper, phrase) {
+				ret.Reason = r.reason
+				return ret
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,67 @@
+package rjsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// failureFrame builds an EAP-Failure frame carrying msg in GBK.
+func failureFrame(t *testing.T, msg string) []byte {
+	t.Helper()
+	body := successPayload(gbk(t, msg), 0, nil)
+	buf := append([]byte{byte(layers.EAPCodeFailure), 3, 0, 0}, body...)
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+	return buf
+}
+
+func TestParseFailure(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want error
+	}{
+		{"密码错误", ErrBadCredentials},
+		{"用户名或密码错误，请重新输入", ErrBadCredentials},
+		{"认证失败：用户不存在", ErrBadCredentials},
+		{"该帐号不存在或已被删除", ErrBadCredentials},
+		{"用户已在线，不能重复登录", ErrAccountInUse},
+		{"该账号已在别处登录", ErrAccountInUse},
+		{"超过同时在线用户数限制", ErrAccountInUse},
+		{"帐户余额不足，请及时充值", ErrAccountOverdue},
+		{"您的帐号已欠费停机", ErrAccountOverdue},
+		{"用户已过期", ErrAccountOverdue},
+		{"用户帐号已被禁用", ErrAccountOverdue},
+		{"用户MAC地址绑定错误", ErrMacBinding},
+		{"mac地址不匹配", ErrMacBinding},
+		{"网卡地址与绑定的不一致", ErrMacBinding},
+		{"IP地址绑定错误", ErrIPBinding},
+		{"用户IP绑定错误", ErrIPBinding},
+		{"IP地址与MAC地址绑定不匹配", ErrMacBinding},
+		// words that only contain a phrase must not match
+		{"VIP地址专区维护中", ErrAuthFailed},
+		{"ZIP类型不支持", ErrAuthFailed},
+		{"用户不在线", ErrAuthFailed},
+		{"认证服务器繁忙，请稍后再试", ErrAuthFailed},
+		{"", ErrAuthFailed},
+	}
+	for _, tt := range tests {
+		err := ParseFailure(failureFrame(t, tt.msg))
+		var fe *FailureError
+		if !errors.As(err, &fe) || fe.Message != tt.msg {
+			t.Errorf("%q: ParseFailure() = %#v", tt.msg, err)
+			continue
+		}
+		if fe.Reason != tt.want {
+			t.Errorf("%q: reason %v, want %v", tt.msg, fe.Reason, tt.want)
+		}
+	}
+}
+
+func TestParseFailureTruncated(t *testing.T) {
+	err := ParseFailure([]byte{byte(layers.EAPCodeFailure), 3, 0, 4})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("ParseFailure() = %v, want %v", err, ErrAuthFailed)
+	}
+}
@@ -4,61 +4,255 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
 	"net"
+	"sync"
 
 	"github.com/google/gopacket/layers"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
 )
 
+// eapHeaderLen is the size of the EAP code, identifier and length fields.
+const eapHeaderLen = 4
+
 var (
-	DefaultSnaplen int32 = 1024
-	// MultiCastAddr        = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x03}
 	MultiCastAddr = net.HardwareAddr{0x01, 0xD0, 0xF8, 0x00, 0x00, 0x03}
+	// paeGroupAddr is the IEEE 802.1X PAE group address.
+	paeGroupAddr = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x03}
 )
 
 type Handle struct {
-	PcapHandle             *pcap.Handle
+	mu                     sync.Mutex // guards everything but transport
+	transport              Transport
+	trailer                *Trailer
+	metrics                *Metrics
+	logger                 *slog.Logger
+	dialect                Dialect
+	groupAddr              net.HardwareAddr
 	srcMacAddr, dstMacAddr net.HardwareAddr
 	buffer                 gopacket.SerializeBuffer
 	options                gopacket.SerializeOptions
 }
 
-func NewHandle(dev *pcap.Interface, srcMacAddr net.HardwareAddr) (*Handle, error) {
-	handler, err := pcap.OpenLive(dev.Name, DefaultSnaplen, false, pcap.BlockForever)
+func NewHandle(dev *NetworkDev, srcMacAddr net.HardwareAddr) (*Handle, error) {
+	t, err := openTransport(dev.Name)
 	if err != nil {
 		return nil, err
 	}
-	h := &Handle{
-		PcapHandle: handler,
+	return NewTransportHandle(t, srcMacAddr), nil
+}
+
+// NewTransportHandle builds a Handle that exchanges frames through t.
+func NewTransportHandle(t Transport, srcMacAddr net.HardwareAddr) *Handle {
+	return &Handle{
+		transport:  t,
 		srcMacAddr: srcMacAddr,
 		dstMacAddr: MultiCastAddr,
+		groupAddr:  MultiCastAddr,
+		dialect:    DialectRuijie,
+		trailer:    NewTrailer(),
+		logger:     defaultLogger(),
 		buffer:     gopacket.NewSerializeBuffer(),
 		options:    gopacket.SerializeOptions{FixLengths: false, ComputeChecksums: true},
 	}
-	return h, nil
 }
 
-// Close cleans up the pcap Handle.
+// Close cleans up the underlying Transport.
 func (h *Handle) Close() {
-	h.PcapHandle.Close()
+	h.transport.Close()
+}
+
+// ReadFrame returns the next raw frame received by the underlying Transport.
+func (h *Handle) ReadFrame() ([]byte, error) {
+	return h.transport.ReadFrame()
 }
 
+// send serializes the layers into the shared buffer, h.mu must be held.
 func (h *Handle) send(l ...gopacket.SerializableLayer) error {
-	if err := gopacket.SerializeLayers(h.buffer, h.options, l...); err != nil {
-		return err
+	err := gopacket.SerializeLayers(h.buffer, h.options, l...)
+	if err == nil {
+		err = h.transport.WriteFrame(h.buffer.Bytes())
+	}
+	if err != nil {
+		h.metrics.incSendError()
+		h.logger.Warn("send frame failed", "authenticator", h.dstMacAddr.String(), "err", err)
+	}
+	return err
+}
+
+// SetLogger replaces the logger used to report send failures, secrets are
+// redacted whatever handler l uses.
+func (h *Handle) SetLogger(l *slog.Logger) {
+	h.mu.Lock()
+	h.logger = redactLogger(l)
+	h.mu.Unlock()
+}
+
+// SetMetrics makes the handle count send errors in m.
+func (h *Handle) SetMetrics(m *Metrics) {
+	h.mu.Lock()
+	h.metrics = m
+	h.mu.Unlock()
+}
+
+// SetDialect switches the group address and whether the private trailer is
+// sent. The trailer is rebuilt from scratch when going back to
+// DialectRuijie.
+func (h *Handle) SetDialect(d Dialect) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if bytes.Equal(h.dstMacAddr, h.groupAddr) {
+		h.dstMacAddr = d.groupAddr()
+	}
+	h.groupAddr = d.groupAddr()
+	switch {
+	case d == DialectStandard:
+		h.trailer = nil
+	case h.trailer == nil:
+		h.trailer = NewTrailer()
+	}
+	h.dialect = d
+}
+
+func (h *Handle) Dialect() Dialect {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dialect
+}
+
+// groupJoiner is implemented by transports that only see the multicast
+// groups they joined.
+type groupJoiner interface {
+	JoinGroup(addr net.HardwareAddr) error
+}
+
+// SetGroupAddr replaces the address EAPOL-Start goes to until an
+// authenticator answers, for networks using neither MultiCastAddr nor the
+// PAE group address. SetDialect resets it, so call it afterwards.
+func (h *Handle) SetGroupAddr(addr net.HardwareAddr) error {
+	if j, ok := h.transport.(groupJoiner); ok {
+		if err := j.JoinGroup(addr); err != nil {
+			return err
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if bytes.Equal(h.dstMacAddr, h.groupAddr) {
+		h.dstMacAddr = addr
+	}
+	h.groupAddr = addr
+	return nil
+}
+
+// Trailer returns a copy of the Ruijie private block appended to outgoing
+// frames, nil if none is sent.
+func (h *Handle) Trailer() *Trailer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.trailer == nil {
+		return nil
+	}
+	return h.trailer.Clone()
+}
+
+// SetTrailer replaces the Ruijie private block appended to outgoing frames.
+func (h *Handle) SetTrailer(t *Trailer) {
+	h.mu.Lock()
+	h.trailer = t
+	h.mu.Unlock()
+}
+
+// UpdateTrailer calls f with the trailer locked against concurrent sends.
+// It does nothing if no trailer is sent.
+func (h *Handle) UpdateTrailer(f func(t *Trailer)) {
+	h.mu.Lock()
+	if h.trailer != nil {
+		f(h.trailer)
+	}
+	h.mu.Unlock()
+}
+
+func (h *Handle) fillLayer() (gopacket.Payload, error) {
+	if h.trailer == nil {
+		return nil, nil
 	}
-	return h.PcapHandle.WritePacketData(h.buffer.Bytes())
+	buf, err := h.trailer.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return gopacket.Payload(buf), nil
 }
 
 func (h *Handle) SetDstMacAddr(addr net.HardwareAddr) {
-	if bytes.Compare(h.dstMacAddr, MultiCastAddr) == 0 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if bytes.Compare(h.dstMacAddr, h.groupAddr) == 0 {
 		h.dstMacAddr = addr
 	}
 }
 
+// SrcMacAddr returns the address the handle authenticates.
+func (h *Handle) SrcMacAddr() net.HardwareAddr {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.srcMacAddr
+}
+
+// authenticator returns the address of the authenticator, nil until one
+// answered.
+func (h *Handle) authenticator() net.HardwareAddr {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if bytes.Equal(h.dstMacAddr, h.groupAddr) {
+		return nil
+	}
+	return h.dstMacAddr
+}
+
+// DstMacAddr returns the authenticator address, the dialect's group address
+// until one answered.
+func (h *Handle) DstMacAddr() net.HardwareAddr {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dstMacAddr
+}
+
+// ErrEAPTooLong is returned for type data that does not fit the 16-bit EAP
+// length.
+var ErrEAPTooLong = errors.New("eap response too long")
+
+// eapResponse builds an EAP-Response carrying typeData. The EAP length
+// covers the EAP header and type data (RFC 3748 4.1), the EAPOL length
+// covers the EAPOL body only (802.1X 11.3). The Ruijie trailer that follows
+// the body carries its own length and is counted by neither. The EAP body is
+// written by hand, gopacket's FixLengths leaves out the EAP header and
+// layers.EAP drops the type of an empty response.
+func eapResponse(id uint8, typ layers.EAPType, typeData []byte) (layers.EAPOL, gopacket.Payload, error) {
+	n := eapHeaderLen + 1 + len(typeData)
+	if n > math.MaxUint16 {
+		return layers.EAPOL{}, nil, fmt.Errorf("%w: %d bytes", ErrEAPTooLong, n)
+	}
+	eapol := layers.EAPOL{
+		Version: 0x01,
+		Type:    layers.EAPOLTypeEAP,
+		Length:  uint16(n),
+	}
+	eap := make(gopacket.Payload, n)
+	eap[0] = byte(layers.EAPCodeResponse)
+	eap[1] = id
+	binary.BigEndian.PutUint16(eap[2:], uint16(n))
+	eap[4] = byte(typ)
+	copy(eap[5:], typeData)
+	return eapol, eap, nil
+}
+
 func (h *Handle) SendStartPkt() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	eth := layers.Ethernet{
 		SrcMAC:       h.srcMacAddr,
 		DstMAC:       h.dstMacAddr,
@@ -68,37 +262,41 @@ func (h *Handle) SendStartPkt() error {
 		Version: 0x01,
 		Type:    layers.EAPOLTypeStart,
 	}
-	if err := h.send(&eth, &eapol, &fillLayer); err != nil {
+	fill, err := h.fillLayer()
+	if err != nil {
+		return err
+	}
+	if err := h.send(&eth, &eapol, &fill); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (h *Handle) SendResponseIdentity(id uint8, identity []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	eth := layers.Ethernet{
 		SrcMAC:       h.srcMacAddr,
 		DstMAC:       h.dstMacAddr,
 		EthernetType: layers.EthernetTypeEAPOL,
 	}
-	eapol := layers.EAPOL{
-		Version: 0x01,
-		Type:    layers.EAPOLTypeEAP,
-		Length:  uint16(0x10),
+	eapol, eap, err := eapResponse(id, layers.EAPTypeIdentity, identity)
+	if err != nil {
+		return err
 	}
-	eap := layers.EAP{
-		Code:     layers.EAPCodeResponse,
-		Id:       id,
-		Type:     layers.EAPTypeIdentity,
-		TypeData: identity,
-		Length:   uint16(0x10),
+	fill, err := h.fillLayer()
+	if err != nil {
+		return err
 	}
-	if err := h.send(&eth, &eapol, &eap, &fillLayer); err != nil {
+	if err := h.send(&eth, &eapol, &eap, &fill); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (h *Handle) SendResponseMD5Chall(id uint8, salt, user, pass []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	plain := []byte{id}
 	plain = append(plain, pass...)
 	plain = append(plain, salt[:0x10]...)
@@ -110,25 +308,23 @@ func (h *Handle) SendResponseMD5Chall(id uint8, salt, user, pass []byte) error {
 		DstMAC:       h.dstMacAddr,
 		EthernetType: layers.EthernetTypeEAPOL,
 	}
-	eapol := layers.EAPOL{
-		Version: 0x01,
-		Type:    layers.EAPOLTypeEAP,
-		Length:  uint16(5 + len(data)),
+	eapol, eap, err := eapResponse(id, layers.EAPTypeOTP, data)
+	if err != nil {
+		return err
 	}
-	eap := layers.EAP{
-		Code:     layers.EAPCodeResponse,
-		Id:       id,
-		Type:     layers.EAPTypeOTP,
-		TypeData: data,
-		Length:   eapol.Length,
+	fill, err := h.fillLayer()
+	if err != nil {
+		return err
 	}
-	if err := h.send(&eth, &eapol, &eap, &fillLayer); err != nil {
+	if err := h.send(&eth, &eapol, &eap, &fill); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (h *Handle) SendLogoffPkt() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	eth := layers.Ethernet{
 		SrcMAC:       h.srcMacAddr,
 		DstMAC:       h.dstMacAddr,
@@ -144,17 +340,11 @@ func (h *Handle) SendLogoffPkt() error {
 	return nil
 }
 
-var echoPacket = []byte{0xFF, 0xFF, 0x37, 0x77, 0x7F, 0x9F, 0xFF, 0xFF, 0xD9, 0x13, 0xFF, 0xFF, 0x37, 0x77, 0x7F, 0x9F, 0xFF, 0xFF, 0xF7, 0x2B, 0xFF, 0xFF, 0x37, 0x77, 0x7F, 0x3F, 0xFF}
-
-func (h *Handle) SendEchoPkt(echoNo, echoKey uint32) error {
-	if echoNo != 0x0000102B {
-		dd1, dd2 := echoNo+echoKey, echoNo
-		buf1, buf2 := echoPacket[6:10], echoPacket[16:20]
-		binary.BigEndian.PutUint32(buf1, dd1)
-		binary.BigEndian.PutUint32(buf2, dd2)
-		Symmetric(buf1)
-		Symmetric(buf2)
-	}
+// SendEchoPkt sends the next heartbeat of k.
+func (h *Handle) SendEchoPkt(k *KeepAlive) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	echo := gopacket.Payload(k.Next())
 	eth := layers.Ethernet{
 		SrcMAC:       h.srcMacAddr,
 		DstMAC:       h.dstMacAddr,
@@ -163,9 +353,8 @@ func (h *Handle) SendEchoPkt(echoNo, echoKey uint32) error {
 	eapol := layers.EAPOL{
 		Version: 0x01,
 		Type:    0xbf,
-		Length:  uint16(len(echoPacket)),
+		Length:  uint16(len(echo)),
 	}
-	echo := gopacket.Payload(echoPacket)
 	if err := h.send(&eth, &eapol, &echo); err != nil {
 		return err
 	}
@@ -0,0 +1,71 @@
+package rjsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestEAPResponseLengths(t *testing.T) {
+	salt := bytes.Repeat([]byte{0x5a}, 16)
+	for _, n := range []int{0, 1, 16, 255, 1500} {
+		user := bytes.Repeat([]byte{'u'}, n)
+		for _, tc := range []struct {
+			name     string
+			typ      layers.EAPType
+			typeData int
+			send     func(h *Handle) error
+		}{
+			{"identity", layers.EAPTypeIdentity, n, func(h *Handle) error { return h.SendResponseIdentity(7, user) }},
+			{"md5", layers.EAPTypeOTP, 1 + 16 + n, func(h *Handle) error { return h.SendResponseMD5Chall(7, salt, user, []byte("secret")) }},
+		} {
+			host, auth := NewPipe()
+			h := NewTransportHandle(host, testHostMAC)
+			if err := tc.send(h); err != nil {
+				t.Fatalf("%s/%d: %v", tc.name, n, err)
+			}
+			frame, err := auth.ReadFrame()
+			h.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := eapHeaderLen + 1 + tc.typeData
+			if len(frame) < 14+4+want {
+				t.Fatalf("%s/%d: frame of %d bytes", tc.name, n, len(frame))
+			}
+			eapol, eap := frame[14:], frame[18:]
+			if got := int(binary.BigEndian.Uint16(eapol[2:])); got != want {
+				t.Errorf("%s/%d: eapol length %d, want %d", tc.name, n, got, want)
+			}
+			if got := int(binary.BigEndian.Uint16(eap[2:])); got != want {
+				t.Errorf("%s/%d: eap length %d, want %d", tc.name, n, got, want)
+			}
+			if eap[0] != byte(layers.EAPCodeResponse) || eap[1] != 7 || eap[4] != byte(tc.typ) {
+				t.Errorf("%s/%d: eap header % x", tc.name, n, eap[:5])
+			}
+			if !bytes.Equal(eap[want-n:want], user) {
+				t.Errorf("%s/%d: username not at the end of the eap body", tc.name, n)
+			}
+		}
+	}
+}
+
+func TestEAPResponseTooLong(t *testing.T) {
+	max := 0xffff - eapHeaderLen - 1
+	if _, _, err := eapResponse(1, layers.EAPTypeIdentity, make([]byte, max)); err != nil {
+		t.Fatalf("%d bytes: %v", max, err)
+	}
+	if _, _, err := eapResponse(1, layers.EAPTypeIdentity, make([]byte, max+1)); !errors.Is(err, ErrEAPTooLong) {
+		t.Fatalf("%d bytes: %v, want ErrEAPTooLong", max+1, err)
+	}
+	host, auth := NewPipe()
+	defer auth.Close()
+	h := NewTransportHandle(host, testHostMAC)
+	defer h.Close()
+	if err := h.SendResponseIdentity(1, make([]byte, max+1)); !errors.Is(err, ErrEAPTooLong) {
+		t.Fatalf("SendResponseIdentity: %v, want ErrEAPTooLong", err)
+	}
+}
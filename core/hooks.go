@@ -0,0 +1,112 @@
+package rjsocks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Hook events, passed to the commands in RJSOCKS_EVENT.
+const (
+	HookOnline  = "online"
+	HookOffline = "offline"
+	HookFailure = "failure"
+)
+
+// defaultHookTimeout bounds a hook when Hooks.Timeout is 0.
+const defaultHookTimeout = 30 * time.Second
+
+// Hooks are commands run on state changes, each given as the program and
+// its arguments. They run one at a time and learn about the transition from
+// the RJSOCKS_EVENT, RJSOCKS_STATE, RJSOCKS_PREVIOUS, RJSOCKS_CAUSE,
+// RJSOCKS_ERROR, RJSOCKS_DEVICE, RJSOCKS_ADAPTER and RJSOCKS_USER
+// environment variables.
+type Hooks struct {
+	// Online runs once a login succeeded.
+	Online []string `toml:"online"`
+	// Offline runs when an online session is lost or logged off.
+	Offline []string `toml:"offline"`
+	// Failure runs when a login is rejected or the service fails.
+	Failure []string `toml:"failure"`
+	// Timeout kills a hook running longer, 0 means 30 seconds.
+	Timeout time.Duration `toml:"timeout"`
+}
+
+func (h Hooks) empty() bool {
+	return len(h.Online) == 0 && len(h.Offline) == 0 && len(h.Failure) == 0
+}
+
+// command returns the hook for ev and the name of its event, nil if there
+// is none.
+func (h Hooks) command(ev StateEvent) ([]string, string) {
+	switch {
+	case ev.To == SrvStatHeld || ev.To == SrvStatError:
+		return h.Failure, HookFailure
+	case ev.To.Online() && !ev.From.Online():
+		return h.Online, HookOnline
+	case ev.From.Online() && !ev.To.Online():
+		return h.Offline, HookOffline
+	}
+	return nil, ""
+}
+
+// SetHooks replaces the commands run on state changes.
+func (s *Service) SetHooks(h Hooks) {
+	s.mu.Lock()
+	s.hooks = h
+	s.mu.Unlock()
+	if h.empty() {
+		return
+	}
+	s.hooksOnce.Do(func() {
+		events, _ := s.Subscribe()
+		go func() {
+			for ev := range events {
+				s.runHook(ev)
+			}
+		}()
+	})
+}
+
+func (s *Service) Hooks() Hooks {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hooks
+}
+
+func (s *Service) runHook(ev StateEvent) {
+	h := s.Hooks()
+	argv, event := h.command(ev)
+	if len(argv) == 0 {
+		return
+	}
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := command(ctx, argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(),
+		"RJSOCKS_EVENT="+event,
+		"RJSOCKS_STATE="+ev.To.Name(),
+		"RJSOCKS_PREVIOUS="+ev.From.Name(),
+		"RJSOCKS_CAUSE="+ev.Cause,
+		"RJSOCKS_DEVICE="+s.device,
+		"RJSOCKS_ADAPTER="+s.adapter,
+		"RJSOCKS_USER="+string(s.user),
+	)
+	if ev.Err != nil {
+		cmd.Env = append(cmd.Env, "RJSOCKS_ERROR="+ev.Err.Error())
+	}
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		s.logger().Warn("hook failed", "event", event, "hook", argv[0],
+			"err", fmt.Errorf("%w: %s", err, strings.TrimSpace(decodeOutput(out))))
+		return
+	}
+	s.logger().Info("hook finished", "event", event, "hook", argv[0], "duration", time.Since(start))
+}
@@ -0,0 +1,99 @@
+package rjsocks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var ErrBadChecksum = errors.New("ruijie ip block checksum mismatch")
+
+// IPInfo is the address block in front of the Ruijie trailer. Authenticators
+// that bind users to addresses compare it against their DHCP snooping table.
+type IPInfo struct {
+	DHCP    bool
+	IP      net.IP
+	Mask    net.IPMask
+	Gateway net.IP
+	DNS     net.IP
+}
+
+// MarshalBinary encodes the block the way the official client does: the
+// plain fields are checksummed, then every byte is bit reversed.
+func (info *IPInfo) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, ipInfoLen)
+	copy(buf, ruijieVendor)
+	if info.DHCP {
+		buf[4] = 0x01
+	}
+	copy(buf[5:9], to4(info.IP))
+	copy(buf[9:13], to4(net.IP(info.Mask)))
+	copy(buf[13:17], to4(info.Gateway))
+	copy(buf[17:21], to4(info.DNS))
+	checkSum(buf)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes and verifies an encoded block.
+func (info *IPInfo) UnmarshalBinary(data []byte) error {
+	if len(data) < ipInfoLen {
+		return ErrShortTrailer
+	}
+	buf := make([]byte, ipInfoLen)
+	for i := range buf {
+		buf[i] = byteReverse(data[i])
+	}
+	if !bytes.Equal(buf[:4], ruijieVendor) {
+		return fmt.Errorf("%w: unknown vendor %x", ErrBadAttribute, buf[:4])
+	}
+	check := make([]byte, ipInfoLen)
+	copy(check, buf[:0x15])
+	checkSum(check)
+	if !bytes.Equal(check[0x15:], data[0x15:ipInfoLen]) {
+		return ErrBadChecksum
+	}
+	*info = IPInfo{
+		DHCP:    buf[4] != 0,
+		IP:      net.IP(buf[5:9]),
+		Mask:    net.IPMask(buf[9:13]),
+		Gateway: net.IP(buf[13:17]),
+		DNS:     net.IP(buf[17:21]),
+	}
+	return nil
+}
+
+func (info *IPInfo) String() string {
+	return fmt.Sprintf("ip=%v mask=%v gateway=%v dns=%v dhcp=%v", info.IP, net.IP(info.Mask), info.Gateway, info.DNS, info.DHCP)
+}
+
+func to4(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return net.IPv4zero.To4()
+}
+
+// LookupIPInfo reads the current IPv4 configuration of adapter.
+func LookupIPInfo(adapter string) (*IPInfo, error) {
+	ifc, err := net.InterfaceByName(adapter)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	info := &IPInfo{}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			info.IP = ipnet.IP.To4()
+			info.Mask = ipnet.Mask[len(ipnet.Mask)-net.IPv4len:]
+			break
+		}
+	}
+	if err := lookupRoutes(adapter, info); err != nil {
+		return info, err
+	}
+	return info, nil
+}
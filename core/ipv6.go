@@ -0,0 +1,76 @@
+package rjsocks
+
+import (
+	"fmt"
+	"net"
+)
+
+// maxGlobalIPv6 is how many global addresses fit in the AttrIPv6Global slot.
+const maxGlobalIPv6 = 2
+
+// IPv6Info holds the IPv6 addresses reported in the vendor attributes.
+type IPv6Info struct {
+	LinkLocal net.IP
+	Temporary net.IP
+	Global    []net.IP
+}
+
+// Equal reports whether both hold the same addresses.
+func (info *IPv6Info) Equal(other *IPv6Info) bool {
+	if info == nil || other == nil {
+		return info == other
+	}
+	if !info.LinkLocal.Equal(other.LinkLocal) || !info.Temporary.Equal(other.Temporary) || len(info.Global) != len(other.Global) {
+		return false
+	}
+	for i := range info.Global {
+		if !info.Global[i].Equal(other.Global[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (info *IPv6Info) String() string {
+	return fmt.Sprintf("link-local=%v temporary=%v global=%v", info.LinkLocal, info.Temporary, info.Global)
+}
+
+// apply writes the addresses into the IPv6 attributes, missing addresses are
+// reported as zeros like the official client does.
+func (info *IPv6Info) apply(attrs Attributes) Attributes {
+	global := make([]byte, maxGlobalIPv6*net.IPv6len)
+	for i, ip := range info.Global {
+		if i == maxGlobalIPv6 {
+			break
+		}
+		copy(global[i*net.IPv6len:], to16(ip))
+	}
+	attrs = attrs.Set(AttrIPv6Local, to16(info.LinkLocal))
+	attrs = attrs.Set(AttrIPv6Temp, to16(info.Temporary))
+	return attrs.Set(AttrIPv6Global, global)
+}
+
+func to16(ip net.IP) net.IP {
+	if ip == nil || ip.To4() != nil {
+		return make(net.IP, net.IPv6len)
+	}
+	return ip.To16()
+}
+
+// add sorts ip into info. Only the first address of each kind is kept,
+// except for global ones which fill up to maxGlobalIPv6 slots.
+func (info *IPv6Info) add(ip net.IP, temporary bool) {
+	switch {
+	case ip.To4() != nil:
+	case ip.IsLinkLocalUnicast():
+		if info.LinkLocal == nil {
+			info.LinkLocal = ip
+		}
+	case temporary:
+		if info.Temporary == nil {
+			info.Temporary = ip
+		}
+	case ip.IsGlobalUnicast() && len(info.Global) < maxGlobalIPv6:
+		info.Global = append(info.Global, ip)
+	}
+}
@@ -0,0 +1,45 @@
+package rjsocks
+
+import (
+	"errors"
+
+	"github.com/zalando/go-keyring"
+)
+
+// KeyringStore keeps credentials in the OS keyring: the Windows Credential
+// Manager, the macOS keychain or a Secret Service such as GNOME Keyring.
+type KeyringStore struct {
+	// Service is the name the entries are filed under.
+	Service string
+}
+
+func NewKeyringStore(service string) *KeyringStore {
+	return &KeyringStore{Service: service}
+}
+
+// Available reports whether the OS has a usable keyring, e.g. headless
+// Linux boxes usually lack a Secret Service.
+func (k *KeyringStore) Available() bool {
+	_, err := keyring.Get(k.Service, "")
+	return err == nil || errors.Is(err, keyring.ErrNotFound)
+}
+
+func (k *KeyringStore) Get(user string) (string, error) {
+	pass, err := keyring.Get(k.Service, user)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return "", ErrCredentialNotFound
+	}
+	return pass, err
+}
+
+func (k *KeyringStore) Set(user, password string) error {
+	return keyring.Set(k.Service, user, password)
+}
+
+func (k *KeyringStore) Delete(user string) error {
+	err := keyring.Delete(k.Service, user)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil
+	}
+	return err
+}
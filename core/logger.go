@@ -0,0 +1,164 @@
+package rjsocks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// redacted replaces the value of secret attributes.
+const redacted = "[REDACTED]"
+
+// secretKeys are attribute keys whose values never reach a sink.
+var secretKeys = map[string]bool{
+	"pass":     true,
+	"password": true,
+	"secret":   true,
+	"seed":     true,
+	"token":    true,
+	"echo_key": true,
+}
+
+// maskedKeys are attribute keys whose values are partially shown.
+var maskedKeys = map[string]bool{
+	"user":     true,
+	"username": true,
+	"identity": true,
+}
+
+// RedactHandler hides secrets before records reach the wrapped handler.
+// Secret keys are replaced entirely, user names keep their first character.
+type RedactHandler struct {
+	h slog.Handler
+}
+
+func NewRedactHandler(h slog.Handler) *RedactHandler {
+	if r, ok := h.(*RedactHandler); ok {
+		return r
+	}
+	return &RedactHandler{h: h}
+}
+
+func (r *RedactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return r.h.Enabled(ctx, level)
+}
+
+func (r *RedactHandler) Handle(ctx context.Context, rec slog.Record) error {
+	out := slog.NewRecord(rec.Time, rec.Level, rec.Message, rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return r.h.Handle(ctx, out)
+}
+
+func (r *RedactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	ret := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		ret[i] = redactAttr(a)
+	}
+	return &RedactHandler{h: r.h.WithAttrs(ret)}
+}
+
+func (r *RedactHandler) WithGroup(name string) slog.Handler {
+	return &RedactHandler{h: r.h.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	key := strings.ToLower(a.Key)
+	switch {
+	case secretKeys[key]:
+		return slog.String(a.Key, redacted)
+	case maskedKeys[key]:
+		return slog.String(a.Key, maskString(a.Value.String()))
+	case a.Value.Kind() == slog.KindGroup:
+		group := a.Value.Group()
+		ret := make([]any, len(group))
+		for i, g := range group {
+			ret[i] = redactAttr(g)
+		}
+		return slog.Group(a.Key, ret...)
+	}
+	return a
+}
+
+func maskString(s string) string {
+	r := []rune(s)
+	if len(r) <= 1 {
+		return strings.Repeat("*", len(r))
+	}
+	return string(r[0]) + strings.Repeat("*", len(r)-1)
+}
+
+// defaultLogger goes through the standard log package, so log.SetOutput
+// keeps working for callers that never inject a logger.
+func defaultLogger() *slog.Logger {
+	return slog.New(NewRedactHandler(slog.Default().Handler()))
+}
+
+// redactLogger wraps l so that secrets are always hidden, nil yields the
+// default logger.
+func redactLogger(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return defaultLogger()
+	}
+	return slog.New(NewRedactHandler(l.Handler()))
+}
+
+// Log sinks accepted by OpenLogger.
+const (
+	LogSinkStderr  = "stderr"
+	LogSinkFile    = "file"
+	LogSinkSyslog  = "syslog"
+	LogSinkJournal = "journal"
+)
+
+// OpenLogger builds a redacting logger writing to sink. target is the path
+// for LogSinkFile and the tag for LogSinkSyslog. The returned closer
+// releases the sink.
+func OpenLogger(sink, target string, level slog.Level) (*slog.Logger, io.Closer, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	var closer io.Closer = nopCloser{}
+	switch sink {
+	case "", LogSinkStderr:
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case LogSinkFile:
+		fp, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+		h, closer = slog.NewTextHandler(fp, opts), fp
+	case LogSinkSyslog:
+		w, err := openSyslog(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		// syslog stamps records itself
+		h, closer = slog.NewTextHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: dropTime}), w
+	case LogSinkJournal:
+		jh, err := newJournalHandler(opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		h, closer = jh, jh
+	default:
+		return nil, nil, fmt.Errorf("unknown log sink %q", sink)
+	}
+	return slog.New(NewRedactHandler(h)), closer, nil
+}
+
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	return a
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,151 @@
+//go:build linux
+
+package rjsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"strings"
+	"sync"
+)
+
+func openSyslog(tag string) (io.WriteCloser, error) {
+	if len(tag) == 0 {
+		tag = "rjsocks"
+	}
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
+
+// journalSocket is where systemd-journald accepts native protocol datagrams.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalHandler sends records to journald, attributes become upper case
+// journal fields so they can be filtered with journalctl.
+type journalHandler struct {
+	conn   *net.UnixConn
+	mu     *sync.Mutex
+	level  slog.Leveler
+	attrs  []journalAttr
+	prefix string
+}
+
+// journalAttr is an attribute of WithAttrs with the groups open at the time.
+type journalAttr struct {
+	prefix string
+	attr   slog.Attr
+}
+
+func newJournalHandler(opts *slog.HandlerOptions) (*journalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	var level slog.Leveler = slog.LevelInfo
+	if opts != nil && opts.Level != nil {
+		level = opts.Level
+	}
+	return &journalHandler{conn: conn, mu: new(sync.Mutex), level: level}, nil
+}
+
+func (j *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= j.level.Level()
+}
+
+func (j *journalHandler) Handle(_ context.Context, rec slog.Record) error {
+	buf := new(bytes.Buffer)
+	journalField(buf, "MESSAGE", rec.Message)
+	journalField(buf, "PRIORITY", fmt.Sprint(journalPriority(rec.Level)))
+	journalField(buf, "SYSLOG_IDENTIFIER", "rjsocks")
+	for _, a := range j.attrs {
+		j.appendAttr(buf, a.prefix, a.attr)
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		j.appendAttr(buf, j.prefix, a)
+		return true
+	})
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err := j.conn.Write(buf.Bytes())
+	return err
+}
+
+func (j *journalHandler) appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, g := range v.Group() {
+			j.appendAttr(buf, prefix+a.Key+"_", g)
+		}
+		return
+	}
+	journalField(buf, journalKey(prefix+a.Key), v.String())
+}
+
+func (j *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	ret := *j
+	ret.attrs = append([]journalAttr(nil), j.attrs...)
+	for _, a := range attrs {
+		ret.attrs = append(ret.attrs, journalAttr{prefix: j.prefix, attr: a})
+	}
+	return &ret
+}
+
+func (j *journalHandler) WithGroup(name string) slog.Handler {
+	if len(name) == 0 {
+		return j
+	}
+	ret := *j
+	ret.prefix = j.prefix + name + "_"
+	return &ret
+}
+
+func (j *journalHandler) Close() error {
+	return j.conn.Close()
+}
+
+// journalField appends a field in the native protocol, values containing a
+// newline use the length prefixed binary form.
+func journalField(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalKey maps an attribute key to a valid journal field name.
+func journalKey(key string) string {
+	b := []byte(strings.ToUpper(key))
+	for i, c := range b {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] == '_' || b[0] >= '0' && b[0] <= '9' {
+		return "X" + string(b)
+	}
+	return string(b)
+}
+
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package rjsocks
+
+import (
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestJournalHandlerGroups(t *testing.T) {
+	addr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "journal"), Net: "unixgram"}
+	journal, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &journalHandler{conn: conn, mu: new(sync.Mutex), level: slog.LevelInfo}
+	defer h.Close()
+
+	l := slog.New(h).With("adapter", "eth0").WithGroup("dhcp").With("server", "10.0.0.1").WithGroup("lease")
+	l.Info("bound", "ip", "10.0.0.2", slog.Group("times", "t1", "30m"))
+
+	buf := make([]byte, 4096)
+	n, err := journal.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n")
+	want := []string{
+		"MESSAGE=bound",
+		"PRIORITY=6",
+		"SYSLOG_IDENTIFIER=rjsocks",
+		"ADAPTER=eth0",
+		"DHCP_SERVER=10.0.0.1",
+		"DHCP_LEASE_IP=10.0.0.2",
+		"DHCP_LEASE_TIMES_T1=30m",
+	}
+	if strings.Join(fields, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("fields\n%s\nwant\n%s", strings.Join(fields, "\n"), strings.Join(want, "\n"))
+	}
+}
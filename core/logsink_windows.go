@@ -0,0 +1,24 @@
+//go:build windows
+
+package rjsocks
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+)
+
+var errSinkUnsupported = errors.New("log sink not supported on windows")
+
+func openSyslog(tag string) (io.WriteCloser, error) {
+	return nil, errSinkUnsupported
+}
+
+type journalHandler struct {
+	slog.Handler
+	io.Closer
+}
+
+func newJournalHandler(opts *slog.HandlerOptions) (*journalHandler, error) {
+	return nil, errSinkUnsupported
+}
@@ -0,0 +1,66 @@
+//go:build linux
+
+package rjsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// macvlanModeBridge lets macvlans of one parent reach each other, x/sys
+// lacks the constant.
+const macvlanModeBridge = 4
+
+// CreateMacvlan adds the macvlan name with address mac on top of parent and
+// brings it up, it needs CAP_NET_ADMIN. An existing interface with the same
+// name and address is reused, created reports whether it was added here.
+func CreateMacvlan(name, parent string, mac net.HardwareAddr) (created bool, err error) {
+	if ifc, err := net.InterfaceByName(name); err == nil {
+		if !bytes.Equal(ifc.HardwareAddr, mac) {
+			return false, fmt.Errorf("interface %s exists with address %s, not %s", name, ifc.HardwareAddr, mac)
+		}
+		return false, nil
+	}
+	link, err := net.InterfaceByName(parent)
+	if err != nil {
+		return false, err
+	}
+	msg := unix.IfInfomsg{Family: unix.AF_UNSPEC, Flags: unix.IFF_UP, Change: unix.IFF_UP}
+	buf := (*[unix.SizeofIfInfomsg]byte)(unsafe.Pointer(&msg))[:]
+	index, mode := make([]byte, 4), make([]byte, 4)
+	binary.NativeEndian.PutUint32(index, uint32(link.Index))
+	binary.NativeEndian.PutUint32(mode, macvlanModeBridge)
+	data := appendRtAttr(nil, unix.IFLA_MACVLAN_MODE, mode)
+	info := appendRtAttr(nil, unix.IFLA_INFO_KIND, []byte("macvlan"))
+	info = appendRtAttr(info, unix.IFLA_INFO_DATA|unix.NLA_F_NESTED, data)
+	buf = appendRtAttr(buf, unix.IFLA_IFNAME, append([]byte(name), 0))
+	buf = appendRtAttr(buf, unix.IFLA_LINK, index)
+	buf = appendRtAttr(buf, unix.IFLA_ADDRESS, mac)
+	buf = appendRtAttr(buf, unix.IFLA_LINKINFO|unix.NLA_F_NESTED, info)
+	if err := netlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, buf); err != nil {
+		return false, os.NewSyscallError("rtm_newlink", err)
+	}
+	return true, nil
+}
+
+// DeleteLink removes the interface name, e.g. a macvlan added by
+// CreateMacvlan. A missing interface is not an error.
+func DeleteLink(name string) error {
+	ifc, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil
+	}
+	msg := unix.IfInfomsg{Family: unix.AF_UNSPEC, Index: int32(ifc.Index)}
+	buf := (*[unix.SizeofIfInfomsg]byte)(unsafe.Pointer(&msg))[:]
+	if err := netlinkRequest(unix.RTM_DELLINK, 0, buf); err != nil && !errors.Is(err, unix.ENODEV) {
+		return os.NewSyscallError("rtm_dellink", err)
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package rjsocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSession = errors.New("no such session")
+	// ErrManagerClosed is returned once Run of a Manager has returned.
+	ErrManagerClosed = errors.New("rjsocks: manager closed")
+)
+
+// DefaultRestartBackoff spaces out the restarts of a session that ended
+// with an error.
+var DefaultRestartBackoff BackoffPolicy = ExponentialBackoff(5*time.Second, 5*time.Minute)
+
+// Manager runs several independent sessions in one process, e.g. for the
+// machines of a lab rack authenticating through a single host. Each session
+// has its own interface or macvlan, credentials and keep-alive, and is
+// restarted on its own when it fails.
+type Manager struct {
+	mu       sync.Mutex
+	sessions []*managedSession
+	restart  BackoffPolicy
+	log      *slog.Logger
+	ctx      context.Context // of Run, nil before
+	closed   bool
+	wg       sync.WaitGroup
+	// newService builds the Service of each run, Profile.NewService but
+	// in tests.
+	newService func(p *Profile, src PasswordSource) (*Service, error)
+}
+
+type managedSession struct {
+	profile *Profile
+	pass    []byte
+	// kick asks the supervisor to restart right away.
+	kick chan struct{}
+
+	mu       sync.Mutex // guards the fields below
+	srv      *Service
+	running  bool
+	restarts int
+	lastErr  error
+	stop     context.CancelFunc // ends the current run
+}
+
+// SessionStatus is the state of one session of a Manager.
+type SessionStatus struct {
+	Name      string `json:"name"`
+	Interface string `json:"interface"`
+	// Running is false before Run and once the session was given up.
+	Running  bool `json:"running"`
+	Restarts int  `json:"restarts"`
+	// Failure is the error that ended the last run.
+	Failure string `json:"failure,omitempty"`
+	// Session is the status of the current or last Service.
+	Session *Status `json:"session,omitempty"`
+}
+
+// ManagerStatus sums up the sessions of a Manager.
+type ManagerStatus struct {
+	Total    int             `json:"total"`
+	Online   int             `json:"online"`
+	Sessions []SessionStatus `json:"sessions"`
+}
+
+func NewManager() *Manager {
+	return &Manager{restart: DefaultRestartBackoff, log: defaultLogger(), newService: (*Profile).NewService}
+}
+
+// SetLogger makes the manager and its sessions log to l, each session adds
+// its name.
+func (m *Manager) SetLogger(l *slog.Logger) {
+	l = redactLogger(l)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.log = l
+	for _, ms := range m.sessions {
+		if srv := ms.service(); srv != nil {
+			srv.SetLogger(ms.logger(l))
+		}
+	}
+}
+
+func (m *Manager) logger() *slog.Logger {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.log
+}
+
+// SetRestartPolicy replaces the policy spacing out restarts, failed logins
+// within a session follow the backoff of its profile instead.
+func (m *Manager) SetRestartPolicy(p BackoffPolicy) {
+	m.mu.Lock()
+	m.restart = p
+	m.mu.Unlock()
+}
+
+func (m *Manager) RestartPolicy() BackoffPolicy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.restart
+}
+
+// Add registers a session for p, named after the profile or its interface.
+// The password is read from src, or from the profile's own source if src is
+// nil, right away and kept for restarts, as prompts and pipes cannot be
+// asked twice. Sessions added to a running manager start at once.
+func (m *Manager) Add(p *Profile, src PasswordSource) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	q := *p
+	if len(q.Name) == 0 {
+		q.Name = q.Interface
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrManagerClosed
+	}
+	for _, ms := range m.sessions {
+		if err := q.conflicts(ms.profile); err != nil {
+			return err
+		}
+	}
+	if src == nil {
+		var err error
+		if src, err = q.PasswordSource(); err != nil {
+			return fmt.Errorf("%s: %w", q.Name, err)
+		}
+	}
+	pass, err := src.Password()
+	if err != nil {
+		return fmt.Errorf("%s: %w", q.Name, err)
+	}
+	ms := &managedSession{profile: &q, pass: pass, kick: make(chan struct{}, 1)}
+	m.sessions = append(m.sessions, ms)
+	if m.ctx != nil {
+		m.start(ms)
+	}
+	return nil
+}
+
+// conflicts tells why p and q cannot run side by side: sessions on one
+// link need distinct MAC addresses, or they would answer for each other.
+func (p *Profile) conflicts(q *Profile) error {
+	switch {
+	case p.Name == q.Name:
+		return fmt.Errorf("session %s already exists", p.Name)
+	case p.Interface == q.Interface:
+		return fmt.Errorf("sessions %s and %s both use interface %s", q.Name, p.Name, p.Interface)
+	case p.Macvlan != nil && q.Macvlan != nil:
+		a, _ := net.ParseMAC(p.Macvlan.MAC)
+		b, _ := net.ParseMAC(q.Macvlan.MAC)
+		if bytes.Equal(a, b) {
+			return fmt.Errorf("sessions %s and %s both use address %s", q.Name, p.Name, a)
+		}
+	}
+	return nil
+}
+
+// Run starts every session and supervises them until ctx is cancelled,
+// then closes them and returns ctx.Err(). A Manager runs only once.
+func (m *Manager) Run(ctx context.Context) error {
+	m.mu.Lock()
+	switch {
+	case m.closed || m.ctx != nil:
+		m.mu.Unlock()
+		return ErrManagerClosed
+	case len(m.sessions) == 0:
+		m.mu.Unlock()
+		return errors.New("rjsocks: no sessions to run")
+	}
+	m.ctx = ctx
+	for _, ms := range m.sessions {
+		m.start(ms)
+	}
+	m.mu.Unlock()
+	<-ctx.Done()
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	m.wg.Wait()
+	for _, ms := range m.sessions {
+		clear(ms.pass)
+	}
+	return ctx.Err()
+}
+
+// start supervises ms in its own goroutine, m.mu must be held.
+func (m *Manager) start(ms *managedSession) {
+	ms.mu.Lock()
+	ms.running = true
+	ms.mu.Unlock()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.supervise(m.ctx, ms)
+		ms.mu.Lock()
+		ms.running = false
+		ms.mu.Unlock()
+	}()
+}
+
+// supervise runs ms again and again until ctx is cancelled or the restart
+// policy gives up.
+func (m *Manager) supervise(ctx context.Context, ms *managedSession) {
+	attempt := 0
+	for {
+		online, err := m.runOnce(ctx, ms)
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-ms.kick:
+			m.logger().Info("restarting session", "session", ms.profile.Name)
+			attempt = 0
+			ms.restarted()
+			continue
+		default:
+		}
+		ms.setLastError(err)
+		policy := m.RestartPolicy()
+		if online && policy.ResetOnSuccess() {
+			attempt = 0
+		}
+		delay, ok := policy.Delay(attempt)
+		attempt++
+		if !ok {
+			err = fmt.Errorf("giving up after %d failures: %w", attempt, err)
+			ms.setLastError(err)
+			m.logger().Error("session given up", "session", ms.profile.Name, "err", err)
+			return
+		}
+		m.logger().Warn("session ended, restarting", "session", ms.profile.Name, "delay", delay, "err", err)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		case <-ms.kick:
+			t.Stop()
+		}
+		ms.restarted()
+	}
+}
+
+// runOnce runs a fresh Service for ms and reports whether it got online.
+func (m *Manager) runOnce(ctx context.Context, ms *managedSession) (online bool, err error) {
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	// Restart cancels the run from here on, a restart asked for before is
+	// served by this run
+	ms.mu.Lock()
+	select {
+	case <-ms.kick:
+	default:
+	}
+	ms.stop = stop
+	ms.mu.Unlock()
+	defer func() {
+		ms.mu.Lock()
+		ms.stop = nil
+		ms.mu.Unlock()
+	}()
+	srv, err := m.newService(ms.profile, StaticPassword(ms.pass))
+	if err != nil {
+		return false, err
+	}
+	srv.SetLogger(ms.logger(m.logger()))
+	events, cancel := srv.Subscribe()
+	defer cancel()
+	watched := make(chan bool)
+	go func() {
+		online := false
+		for ev := range events {
+			online = online || ev.To.Online()
+		}
+		watched <- online
+	}()
+	ms.mu.Lock()
+	ms.srv = srv
+	ms.mu.Unlock()
+	err = srv.Run(runCtx)
+	// the events end with the service
+	online = <-watched
+	if err == nil {
+		err = ErrServiceClosed
+	}
+	return online, err
+}
+
+// Restart ends the current run of the named session and starts a new one
+// right away, also if the session was given up.
+func (m *Manager) Restart(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ms := m.find(name)
+	if ms == nil {
+		return fmt.Errorf("%w: %s", ErrNoSession, name)
+	}
+	if m.ctx == nil || m.closed {
+		return errors.New("rjsocks: manager not running")
+	}
+	// kicking under ms.mu pairs with runOnce installing stop
+	ms.mu.Lock()
+	running, stop := ms.running, ms.stop
+	if running {
+		select {
+		case ms.kick <- struct{}{}:
+		default:
+		}
+	}
+	ms.mu.Unlock()
+	if !running {
+		ms.restarted()
+		m.start(ms)
+		return nil
+	}
+	if stop != nil {
+		stop()
+	}
+	return nil
+}
+
+// find returns the session called name, m.mu must be held.
+func (m *Manager) find(name string) *managedSession {
+	for _, ms := range m.sessions {
+		if ms.profile.Name == name {
+			return ms
+		}
+	}
+	return nil
+}
+
+// Names returns the session names in the order they were added.
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, len(m.sessions))
+	for i, ms := range m.sessions {
+		names[i] = ms.profile.Name
+	}
+	return names
+}
+
+// Service returns the current Service of the named session, nil if it has
+// not started yet.
+func (m *Manager) Service(name string) *Service {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ms := m.find(name); ms != nil {
+		return ms.service()
+	}
+	return nil
+}
+
+// Status returns the state of every session and how many are online.
+func (m *Manager) Status() ManagerStatus {
+	m.mu.Lock()
+	sessions := append([]*managedSession(nil), m.sessions...)
+	m.mu.Unlock()
+	st := ManagerStatus{Total: len(sessions), Sessions: make([]SessionStatus, 0, len(sessions))}
+	for _, ms := range sessions {
+		ss := ms.status()
+		if ss.Running && ss.Session != nil && ss.Session.Online {
+			st.Online++
+		}
+		st.Sessions = append(st.Sessions, ss)
+	}
+	return st
+}
+
+func (ms *managedSession) logger(l *slog.Logger) *slog.Logger {
+	return l.With("session", ms.profile.Name)
+}
+
+func (ms *managedSession) service() *Service {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.srv
+}
+
+func (ms *managedSession) setLastError(err error) {
+	ms.mu.Lock()
+	ms.lastErr = err
+	ms.mu.Unlock()
+}
+
+func (ms *managedSession) restarted() {
+	ms.mu.Lock()
+	ms.restarts++
+	ms.mu.Unlock()
+}
+
+func (ms *managedSession) status() SessionStatus {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ss := SessionStatus{
+		Name:      ms.profile.Name,
+		Interface: ms.profile.Interface,
+		Running:   ms.running,
+		Restarts:  ms.restarts,
+	}
+	if ms.lastErr != nil {
+		ss.Failure = ms.lastErr.Error()
+	}
+	if ms.srv != nil {
+		st := ms.srv.Status()
+		ss.Session = &st
+	}
+	return ss
+}
@@ -0,0 +1,99 @@
+package rjsocks
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestManager runs one session whose services come from build. wait
+// returns what Run returned.
+func newTestManager(t *testing.T, build func(n int32) (*Service, error)) (m *Manager, cancel context.CancelFunc, wait func() error) {
+	t.Helper()
+	m = NewManager()
+	m.SetRestartPolicy(ExponentialBackoff(time.Hour, time.Hour))
+	var builds int32
+	m.newService = func(*Profile, PasswordSource) (*Service, error) {
+		return build(atomic.AddInt32(&builds, 1))
+	}
+	if err := m.Add(&Profile{Name: "rack1", User: "2017xxxx", Interface: "test0"}, StaticPassword("secret")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var err error
+	go func() {
+		err = m.Run(ctx)
+		close(done)
+	}()
+	wait = func() error {
+		<-done
+		return err
+	}
+	t.Cleanup(func() {
+		cancel()
+		wait()
+	})
+	return m, cancel, wait
+}
+
+func TestManagerRestartWhileStarting(t *testing.T) {
+	creating, release := make(chan struct{}), make(chan struct{})
+	started := make(chan int32, 4)
+	m, cancel, wait := newTestManager(t, func(n int32) (*Service, error) {
+		if n == 1 {
+			close(creating)
+			<-release
+		}
+		s, _ := newTestService(t)
+		started <- n
+		return s, nil
+	})
+	<-creating
+	if err := m.Restart("rack1"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	for want := int32(1); want <= 2; want++ {
+		select {
+		case n := <-started:
+			if n != want {
+				t.Fatalf("service %d started, want %d", n, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("service %d not started, the restart was lost", want)
+		}
+	}
+	if st := m.Status(); st.Sessions[0].Restarts != 1 || !st.Sessions[0].Running {
+		t.Fatalf("status %+v", st.Sessions[0])
+	}
+	cancel()
+	if err := wait(); err != context.Canceled {
+		t.Fatalf("Run returned %v", err)
+	}
+}
+
+func TestManagerRestartRunning(t *testing.T) {
+	started := make(chan *Service, 4)
+	m, _, _ := newTestManager(t, func(n int32) (*Service, error) {
+		s, _ := newTestService(t)
+		started <- s
+		return s, nil
+	})
+	first := <-started
+	if err := m.Restart("rack1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-started:
+		if s == first || m.Service("rack1") != s {
+			t.Fatal("restart kept the old service")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no new service after Restart")
+	}
+	if err := m.Restart("nope"); err == nil {
+		t.Fatal("restarted an unknown session")
+	}
+}
@@ -0,0 +1,228 @@
+package rjsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Metrics counts authentication health of a Service and renders it in the
+// Prometheus text exposition format. A nil *Metrics counts nothing.
+type Metrics struct {
+	mu             sync.Mutex
+	authAttempts   uint64
+	authSuccesses  uint64
+	authFailures   map[string]uint64
+	keepAlives     uint64
+	framesReceived map[string]uint64
+	sendErrors     uint64
+	state          SrvStat
+	lastSuccess    time.Time
+	now            func() time.Time
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		authFailures:   make(map[string]uint64),
+		framesReceived: make(map[string]uint64),
+		now:            time.Now,
+	}
+}
+
+func (m *Metrics) incAuthAttempt() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.authAttempts++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) incAuthSuccess() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.authSuccesses++
+	m.lastSuccess = m.now()
+	m.mu.Unlock()
+}
+
+func (m *Metrics) incAuthFailure(reason error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.authFailures[failureLabel(reason)]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) incKeepAlive() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.keepAlives++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) incFrame(code layers.EAPCode) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.framesReceived[eapCodeLabel(code)]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) incSendError() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.sendErrors++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) setState(state SrvStat) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.state = state
+	m.mu.Unlock()
+}
+
+func failureLabel(err error) string {
+	switch {
+	case errors.Is(err, ErrBadCredentials):
+		return "bad_credentials"
+	case errors.Is(err, ErrAccountInUse):
+		return "account_in_use"
+	case errors.Is(err, ErrAccountOverdue):
+		return "account_overdue"
+	case errors.Is(err, ErrMacBinding):
+		return "mac_binding"
+	case errors.Is(err, ErrIPBinding):
+		return "ip_binding"
+	}
+	return "unknown"
+}
+
+func eapCodeLabel(code layers.EAPCode) string {
+	switch code {
+	case layers.EAPCodeRequest:
+		return "request"
+	case layers.EAPCodeResponse:
+		return "response"
+	case layers.EAPCodeSuccess:
+		return "success"
+	case layers.EAPCodeFailure:
+		return "failure"
+	}
+	return fmt.Sprintf("%d", uint8(code))
+}
+
+// WriteTo renders the metrics in the Prometheus text format, nothing for a
+// nil *Metrics.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ew := &errWriter{w: w}
+	metric := func(name, typ, help string) {
+		ew.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	labeled := func(name, label string, values map[string]uint64) {
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ew.printf("%s{%s=%q} %d\n", name, label, k, values[k])
+		}
+	}
+
+	metric("rjsocks_auth_attempts_total", "counter", "EAPOL-Start frames sent to begin an authentication.")
+	ew.printf("rjsocks_auth_attempts_total %d\n", m.authAttempts)
+	metric("rjsocks_auth_successes_total", "counter", "EAP-Success frames received.")
+	ew.printf("rjsocks_auth_successes_total %d\n", m.authSuccesses)
+	metric("rjsocks_auth_failures_total", "counter", "EAP-Failure frames received, by decoded reason.")
+	labeled("rjsocks_auth_failures_total", "reason", m.authFailures)
+	metric("rjsocks_keepalive_frames_total", "counter", "Heartbeat frames sent.")
+	ew.printf("rjsocks_keepalive_frames_total %d\n", m.keepAlives)
+	metric("rjsocks_frames_received_total", "counter", "EAP frames received, by EAP code.")
+	labeled("rjsocks_frames_received_total", "code", m.framesReceived)
+	metric("rjsocks_send_errors_total", "counter", "Frames that could not be sent.")
+	ew.printf("rjsocks_send_errors_total %d\n", m.sendErrors)
+	metric("rjsocks_state", "gauge", "Current supplicant state, 1 for the active one.")
+	for s := SrvStatLoggedOff; s <= SrvStatError; s++ {
+		v := 0
+		if s == m.state {
+			v = 1
+		}
+		ew.printf("rjsocks_state{state=%q} %d\n", s.Name(), v)
+	}
+	if !m.lastSuccess.IsZero() {
+		metric("rjsocks_last_success_timestamp_seconds", "gauge", "Unix time of the last successful login.")
+		ew.printf("rjsocks_last_success_timestamp_seconds %d\n", m.lastSuccess.Unix())
+		metric("rjsocks_seconds_since_last_success", "gauge", "Seconds since the last successful login.")
+		ew.printf("rjsocks_seconds_since_last_success %.3f\n", m.now().Sub(m.lastSuccess).Seconds())
+	}
+	return ew.n, ew.err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// ServeMetrics serves m on addr under /metrics until ctx is cancelled.
+func ServeMetrics(ctx context.Context, addr string, m *Metrics) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			srv.Close()
+		case <-stop:
+		}
+	}()
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+type errWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (e *errWriter) printf(format string, a ...interface{}) {
+	if e.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(e.w, format, a...)
+	e.n += int64(n)
+	e.err = err
+}
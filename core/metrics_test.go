@@ -0,0 +1,92 @@
+package rjsocks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestMetricsScrape(t *testing.T) {
+	s, a := newTestService(t)
+	clock := newFakeClock()
+	s.crontab = NewClockCrontab(clock)
+	s.SetBackoffPolicy(ExponentialBackoff(time.Hour, time.Hour))
+	m := NewMetrics()
+	s.SetMetrics(m)
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go s.Run(ctx)
+
+	a.next(layers.EAPOLTypeStart)
+	a.login(1)
+	a.send(layers.EAPCodeFailure, 2, 0, nil, successPayload(gbk(t, "密码错误"), 0, nil))
+	a.login(3)
+	a.send(layers.EAPCodeSuccess, 4, 0, nil, successPayload(nil, 0x540c, nil))
+	deadline := time.Now().Add(2 * time.Second)
+	for !s.crontab.Exist("Echo") {
+		if time.Now().After(deadline) {
+			t.Fatal("keep-alive not scheduled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(DefaultKeepAliveInterval)
+	a.next(0xbf)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("content type %q", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		if i := strings.LastIndexByte(line, ' '); i > 0 && !strings.HasPrefix(line, "#") {
+			samples[line[:i]] = line[i+1:]
+		}
+	}
+	for name, want := range map[string]string{
+		"rjsocks_auth_attempts_total":                           "1",
+		"rjsocks_auth_successes_total":                          "1",
+		`rjsocks_auth_failures_total{reason="bad_credentials"}`: "1",
+		"rjsocks_keepalive_frames_total":                        "1",
+		`rjsocks_frames_received_total{code="request"}`:         "4",
+		`rjsocks_frames_received_total{code="failure"}`:         "1",
+		`rjsocks_frames_received_total{code="success"}`:         "1",
+		"rjsocks_send_errors_total":                             "0",
+		`rjsocks_state{state="keep_alive"}`:                     "1",
+		`rjsocks_state{state="authenticated"}`:                  "0",
+	} {
+		if got, ok := samples[name]; !ok || got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, ok := samples["rjsocks_seconds_since_last_success"]; !ok {
+		t.Error("rjsocks_seconds_since_last_success missing")
+	}
+	if t.Failed() {
+		t.Logf("scrape:\n%s", body)
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatalf("nil metrics served %d %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,199 @@
+package rjsocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+var (
+	ErrNoPassword = errors.New("no password given")
+	// ErrNotTerminal is returned when a prompt is asked for without a
+	// terminal to ask on.
+	ErrNotTerminal = errors.New("stdin is not a terminal")
+)
+
+// passwordCommandTimeout bounds a CommandPassword, long enough to unlock
+// a gpg key.
+const passwordCommandTimeout = 2 * time.Minute
+
+// PasswordSource yields a password on demand. The caller owns the returned
+// slice and should clear it once done.
+type PasswordSource interface {
+	Password() ([]byte, error)
+}
+
+// ParsePasswordSource parses a password source without reading it:
+//
+//	env:NAME     the environment variable NAME
+//	file:PATH    the first line of PATH, which only its owner may read
+//	cmd:COMMAND  the first line printed by COMMAND, e.g. "cmd:pass show wifi",
+//	             split on spaces and run without a shell
+//	prompt       asked for on the terminal
+//	stdin        the first line of the standard input
+func ParsePasswordSource(spec string) (PasswordSource, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "env", "file", "cmd":
+		if len(strings.TrimSpace(arg)) == 0 {
+			return nil, fmt.Errorf("password source %q lacks its argument", spec)
+		}
+	case "prompt", "stdin":
+		if len(arg) > 0 {
+			return nil, fmt.Errorf("password source %s takes no argument", kind)
+		}
+	}
+	switch kind {
+	case "env":
+		return EnvPassword(arg), nil
+	case "file":
+		return FilePassword(arg), nil
+	case "cmd":
+		return CommandPassword(strings.Fields(arg)), nil
+	case "prompt":
+		return PromptPassword("Password: "), nil
+	case "stdin":
+		return StdinPassword{}, nil
+	}
+	return nil, fmt.Errorf("unknown password source %q, want env:NAME, file:PATH, cmd:COMMAND, prompt or stdin", spec)
+}
+
+// StaticPassword is a password already at hand, each call returns a copy.
+type StaticPassword []byte
+
+func (p StaticPassword) Password() ([]byte, error) {
+	if len(p) == 0 {
+		return nil, ErrNoPassword
+	}
+	return bytes.Clone(p), nil
+}
+
+// EnvPassword reads the named environment variable.
+type EnvPassword string
+
+func (e EnvPassword) Password() ([]byte, error) {
+	pass, ok := os.LookupEnv(string(e))
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", string(e))
+	}
+	if len(pass) == 0 {
+		return nil, fmt.Errorf("environment variable %s is empty", string(e))
+	}
+	return []byte(pass), nil
+}
+
+// FilePassword reads the first line of a file. It refuses files that
+// others could read, see checkSecretFile.
+type FilePassword string
+
+func (f FilePassword) Password() ([]byte, error) {
+	path := string(f)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("password file %s is not a regular file", path)
+	}
+	if err := checkSecretFile(path, fi); err != nil {
+		return nil, err
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(buf)
+	return firstLine(buf, "password file "+path)
+}
+
+// CommandPassword runs a helper such as pass or secret-tool and takes the
+// first line it prints. The helper shares the terminal, so it may prompt.
+type CommandPassword []string
+
+func (c CommandPassword) Password() ([]byte, error) {
+	if len(c) == 0 {
+		return nil, errors.New("no password command given")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), passwordCommandTimeout)
+	defer cancel()
+	cmd := command(ctx, c[0], c[1:]...)
+	cmd.Stdin, cmd.Stderr = os.Stdin, os.Stderr
+	out, err := cmd.Output()
+	defer clear(out)
+	if err != nil {
+		return nil, fmt.Errorf("password command %s: %w", c[0], err)
+	}
+	return firstLine(out, "password command "+c[0])
+}
+
+// PromptPassword asks on the terminal without echoing, the value is the
+// prompt written to stderr.
+type PromptPassword string
+
+func (p PromptPassword) Password() ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, ErrNotTerminal
+	}
+	fmt.Fprint(os.Stderr, string(p))
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(pass) == 0 {
+		return nil, ErrNoPassword
+	}
+	return pass, nil
+}
+
+// StdinPassword reads the first line of the standard input, for pipes. On a
+// terminal it prompts like PromptPassword.
+type StdinPassword struct{}
+
+func (StdinPassword) Password() ([]byte, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return PromptPassword("Password: ").Password()
+	}
+	r := bufio.NewReader(os.Stdin)
+	line, err := r.ReadSlice('\n')
+	if err != nil && len(line) == 0 {
+		return nil, fmt.Errorf("reading the password from stdin: %w", err)
+	}
+	// line points into the reader's buffer
+	defer clear(line)
+	return firstLine(line, "stdin")
+}
+
+// firstLine copies the first line of buf without its line ending.
+func firstLine(buf []byte, what string) ([]byte, error) {
+	line, _, _ := bytes.Cut(buf, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%s: %w", what, ErrNoPassword)
+	}
+	return bytes.Clone(line), nil
+}
+
+// NewServiceFrom is NewService with the password read from src. The
+// password is cleared when the service closes.
+func NewServiceFrom(usr string, src PasswordSource, dev, adap string) (*Service, error) {
+	pass, err := src.Password()
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewService(usr, "", dev, adap)
+	if err != nil {
+		clear(pass)
+		return nil, err
+	}
+	s.pass = pass
+	return s, nil
+}
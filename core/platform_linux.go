@@ -0,0 +1,131 @@
+//go:build linux
+
+package rjsocks
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// findAllDevs lists the non-loopback interfaces. Linux has no separate
+// driver description, so the interface name is used for both.
+func findAllDevs() ([]NetworkDev, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ret []NetworkDev
+	for _, ifc := range interfaces {
+		if ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ret = append(ret, NetworkDev{Name: ifc.Name, Description: ifc.Name})
+	}
+	return ret, nil
+}
+
+// openTransport uses a raw AF_PACKET socket, which keeps the core free of
+// cgo. Build with the pcap tag to have OpenPcapTransport available as well.
+func openTransport(name string) (Transport, error) {
+	return OpenPacketTransport(name)
+}
+
+func command(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, arg...)
+}
+
+// checkSecretFile refuses secrets that other users could read or replace.
+func checkSecretFile(path string, fi os.FileInfo) error {
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("%s is accessible by others (mode %04o), chmod 600 it", path, perm)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() && st.Uid != 0 {
+		return fmt.Errorf("%s is owned by uid %d, not by the current user or root", path, st.Uid)
+	}
+	return nil
+}
+
+// autoRenewMethods are tried in order by the RenewAuto method.
+var autoRenewMethods = []string{RenewDhclient, RenewUdhcpc, RenewDhcpcd, RenewNmcli}
+
+func decodeOutput(out []byte) string {
+	return string(out)
+}
+
+// lookupRoutes fills the default gateway from /proc/net/route and the first
+// IPv4 name server from /etc/resolv.conf.
+func lookupRoutes(adapter string, info *IPInfo) error {
+	routes, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(routes), "\n")[1:] {
+		f := strings.Fields(line)
+		if len(f) < 3 || f[0] != adapter || f[1] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(f[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		info.Gateway = make(net.IP, net.IPv4len)
+		binary.NativeEndian.PutUint32(info.Gateway, uint32(gw))
+		break
+	}
+	conf, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(conf), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(f[1]).To4(); ip != nil {
+			info.DNS = ip
+			break
+		}
+	}
+	return nil
+}
+
+// IFA_F_* flags from linux/if_addr.h.
+const (
+	ifaFlagTemporary  = 0x01
+	ifaFlagDadFailed  = 0x08
+	ifaFlagDeprecated = 0x20
+	ifaFlagTentative  = 0x40
+)
+
+// LookupIPv6Info reads the IPv6 addresses of adapter from /proc/net/if_inet6.
+func LookupIPv6Info(adapter string) (*IPv6Info, error) {
+	data, err := os.ReadFile("/proc/net/if_inet6")
+	if err != nil {
+		return nil, err
+	}
+	info := &IPv6Info{}
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 6 || f[5] != adapter {
+			continue
+		}
+		addr, err := hex.DecodeString(f[0])
+		if err != nil || len(addr) != net.IPv6len {
+			continue
+		}
+		flags, err := strconv.ParseUint(f[4], 16, 32)
+		if err != nil || flags&(ifaFlagDadFailed|ifaFlagDeprecated|ifaFlagTentative) != 0 {
+			continue
+		}
+		info.add(net.IP(addr), flags&ifaFlagTemporary != 0)
+	}
+	return info, nil
+}
@@ -0,0 +1,148 @@
+//go:build windows
+
+package rjsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/sys/windows"
+)
+
+// findAllDevs lists the WinPcap devices. Their names are NPF GUIDs, so the
+// user is shown the driver description instead.
+func findAllDevs() ([]NetworkDev, error) {
+	interfaces, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+	var ret []NetworkDev
+	for _, ifc := range interfaces {
+		ret = append(ret, NetworkDev{Name: ifc.Name, Description: ifc.Description})
+	}
+	return ret, nil
+}
+
+func openTransport(name string) (Transport, error) {
+	return OpenPcapTransport(name)
+}
+
+func openDHCPTransport(name string) (Transport, error) {
+	return openPcapFilter(name, "udp dst port 68")
+}
+
+// DefaultConfigurator returns nil, Windows leases are only reported to the
+// authenticator.
+func DefaultConfigurator() Configurator {
+	return nil
+}
+
+// checkSecretFile accepts any file, Windows access is governed by ACLs that
+// are not inspected here.
+func checkSecretFile(path string, fi os.FileInfo) error {
+	return nil
+}
+
+// command prepares cmd without popping up a console window.
+func command(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	return cmd
+}
+
+// errMacvlanUnsupported is returned by the macvlan helpers, Windows has no
+// such thing.
+var errMacvlanUnsupported = errors.New("macvlan is only supported on linux")
+
+func CreateMacvlan(name, parent string, mac net.HardwareAddr) (bool, error) {
+	return false, errMacvlanUnsupported
+}
+
+func DeleteLink(name string) error {
+	return errMacvlanUnsupported
+}
+
+// autoRenewMethods are tried in order by the RenewAuto method.
+var autoRenewMethods = []string{RenewIpconfig}
+
+// decodeOutput converts console output, which uses the ANSI code page.
+func decodeOutput(out []byte) string {
+	if s, err := GbkToUtf8(out); err == nil {
+		return string(s)
+	}
+	return string(out)
+}
+
+// adapterAddresses returns the IP Helper view of all adapters.
+func adapterAddresses(family uint32, flags uint32) (*windows.IpAdapterAddresses, error) {
+	size := uint32(15000)
+	for {
+		buf := make([]byte, size)
+		aa := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0]))
+		err := windows.GetAdaptersAddresses(family, flags, 0, aa, &size)
+		if err == nil {
+			if size == 0 {
+				return nil, nil
+			}
+			return aa, nil
+		}
+		if err != windows.ERROR_BUFFER_OVERFLOW {
+			return nil, os.NewSyscallError("getadaptersaddresses", err)
+		}
+	}
+}
+
+// lookupRoutes fills the gateway, DNS server and DHCP state from the IP
+// Helper API, adapters are matched by their friendly name.
+func lookupRoutes(adapter string, info *IPInfo) error {
+	aa, err := adapterAddresses(windows.AF_INET, windows.GAA_FLAG_INCLUDE_GATEWAYS)
+	if err != nil {
+		return err
+	}
+	for ; aa != nil; aa = aa.Next {
+		if windows.UTF16PtrToString(aa.FriendlyName) != adapter {
+			continue
+		}
+		info.DHCP = aa.Flags&ipAdapterDhcpEnabled != 0
+		if aa.FirstGatewayAddress != nil {
+			info.Gateway = aa.FirstGatewayAddress.Address.IP().To4()
+		}
+		if aa.FirstDnsServerAddress != nil {
+			info.DNS = aa.FirstDnsServerAddress.Address.IP().To4()
+		}
+		return nil
+	}
+	return errors.New("无法获取对应网卡")
+}
+
+// ipAdapterDhcpEnabled is IP_ADAPTER_DHCP_ENABLED from iptypes.h.
+const ipAdapterDhcpEnabled = 0x4
+
+// LookupIPv6Info reads the IPv6 addresses of adapter from the IP Helper API.
+// Privacy extension addresses have a random suffix.
+func LookupIPv6Info(adapter string) (*IPv6Info, error) {
+	aa, err := adapterAddresses(windows.AF_INET6, 0)
+	if err != nil {
+		return nil, err
+	}
+	for ; aa != nil; aa = aa.Next {
+		if windows.UTF16PtrToString(aa.FriendlyName) != adapter {
+			continue
+		}
+		info := &IPv6Info{}
+		for ua := aa.FirstUnicastAddress; ua != nil; ua = ua.Next {
+			if ua.DadState != windows.IpDadStatePreferred {
+				continue
+			}
+			info.add(ua.Address.IP(), ua.SuffixOrigin == windows.IpSuffixOriginRandom)
+		}
+		return info, nil
+	}
+	return nil, errors.New("无法获取对应网卡")
+}
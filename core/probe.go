@@ -0,0 +1,92 @@
+package rjsocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var ErrNoAuthenticator = errors.New("no authenticator answered")
+
+// ProbeResult describes the authenticator that answered an EAPOL-Start.
+type ProbeResult struct {
+	Authenticator net.HardwareAddr
+	// Dialect is DialectRuijie if the request carried a private trailer.
+	Dialect Dialect
+	EapID   uint8
+	RTT     time.Duration
+}
+
+// Probe sends an EAPOL-Start through h and waits for the Request/Identity
+// without authenticating, the half open session is logged off afterwards.
+// h is closed when Probe returns.
+func Probe(ctx context.Context, h *Handle) (*ProbeResult, error) {
+	defer h.Close()
+	type reply struct {
+		eth *layers.Ethernet
+		eap *layers.EAP
+		at  time.Time
+	}
+	replies := make(chan reply, 1)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			data, err := h.ReadFrame()
+			if err != nil {
+				if err == ErrTransportClosed {
+					err = io.EOF
+				}
+				errc <- err
+				return
+			}
+			at := time.Now()
+			packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+			l := packet.Layer(layers.LayerTypeEAP)
+			if l == nil {
+				continue
+			}
+			eap := l.(*layers.EAP)
+			if eap.Code != layers.EAPCodeRequest || eap.Type != layers.EAPTypeIdentity {
+				continue
+			}
+			replies <- reply{packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet), eap, at}
+			return
+		}
+	}()
+	start := time.Now()
+	if err := h.SendStartPkt(); err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, ErrNoAuthenticator
+		}
+		return nil, ctx.Err()
+	case err := <-errc:
+		if err == io.EOF {
+			return nil, ErrNoAuthenticator
+		}
+		return nil, err
+	case r := <-replies:
+		res := &ProbeResult{
+			Authenticator: r.eth.SrcMAC,
+			Dialect:       DialectStandard,
+			EapID:         r.eap.Id,
+			RTT:           r.at.Sub(start),
+		}
+		// behind the EAP packet is either zero padding or the trailer
+		if len(bytes.Trim(r.eap.Payload, "\x00")) > 0 {
+			res.Dialect = DialectRuijie
+		}
+		h.SetDstMacAddr(r.eth.SrcMAC)
+		h.SendLogoffPkt()
+		return res, nil
+	}
+}
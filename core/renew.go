@@ -0,0 +1,111 @@
+package rjsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Renew methods accepted by NewRenewer.
+const (
+	RenewAuto     = "auto"
+	RenewNone     = "none"
+	RenewIpconfig = "ipconfig"
+	RenewDhclient = "dhclient"
+	RenewUdhcpc   = "udhcpc"
+	RenewDhcpcd   = "dhcpcd"
+	RenewNmcli    = "nmcli"
+)
+
+var (
+	ErrUnknownRenewer = errors.New("unknown ip renew method")
+	errNoDhcpClient   = errors.New("no dhcp client found in PATH")
+)
+
+// Renewer refreshes the IP configuration of an adapter once the port has
+// been authorized.
+type Renewer interface {
+	Method() string
+	Renew(ctx context.Context, adapter string) error
+}
+
+// RenewResult records the outcome of the last IP renewal.
+type RenewResult struct {
+	Method   string
+	Time     time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// commandRenewer runs an external DHCP client and waits for it.
+type commandRenewer struct {
+	name string
+	args func(adapter string) []string
+}
+
+var commandRenewers = []*commandRenewer{
+	{RenewIpconfig, func(adapter string) []string { return []string{"/renew", adapter} }},
+	{RenewDhclient, func(adapter string) []string { return []string{"-1", adapter} }},
+	{RenewUdhcpc, func(adapter string) []string { return []string{"-i", adapter, "-n", "-q"} }},
+	{RenewDhcpcd, func(adapter string) []string { return []string{"-n", adapter} }},
+	{RenewNmcli, func(adapter string) []string { return []string{"device", "reapply", adapter} }},
+}
+
+func (r *commandRenewer) Method() string {
+	return r.name
+}
+
+func (r *commandRenewer) Renew(ctx context.Context, adapter string) error {
+	out, err := command(ctx, r.name, r.args(adapter)...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(decodeOutput(out)); len(msg) > 0 {
+		return fmt.Errorf("%s: %w: %s", r.name, err, msg)
+	}
+	return fmt.Errorf("%s: %w", r.name, err)
+}
+
+// autoRenewer uses the first of the platform's usual clients found in PATH.
+type autoRenewer struct{}
+
+func (autoRenewer) Method() string {
+	return RenewAuto
+}
+
+func (autoRenewer) Renew(ctx context.Context, adapter string) error {
+	for _, name := range autoRenewMethods {
+		if _, err := exec.LookPath(name); err != nil {
+			continue
+		}
+		r, _ := NewRenewer(name)
+		return r.Renew(ctx, adapter)
+	}
+	return errNoDhcpClient
+}
+
+type noneRenewer struct{}
+
+func (noneRenewer) Method() string { return RenewNone }
+
+func (noneRenewer) Renew(context.Context, string) error { return nil }
+
+// NewRenewer returns the Renewer for method, an empty method means
+// RenewAuto.
+func NewRenewer(method string) (Renewer, error) {
+	switch method {
+	case "", RenewAuto:
+		return autoRenewer{}, nil
+	case RenewNone:
+		return noneRenewer{}, nil
+	}
+	for _, r := range commandRenewers {
+		if r.name == method {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownRenewer, method)
+}
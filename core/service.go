@@ -2,61 +2,59 @@ package rjsocks
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
-type SrvStat int
+var ErrServiceClosed = errors.New("rjsocks: service closed")
 
-const (
-	SrvStatStart = SrvStat(iota)
-	SrvStatRespIdentity
-	SrvStatRespMd5Chall
-	SrvStatSuccess
-	SrvStatFailure
-	SrvStatKeepAlive
-	SrvStatError
-)
-
-func (s SrvStat) String() string {
-	switch s {
-	case SrvStatStart:
-		return "请求认证..."
-	case SrvStatRespIdentity:
-		return "开始认证..."
-	case SrvStatRespMd5Chall:
-		return "认证中..."
-	case SrvStatKeepAlive:
-		return "保持认证状态"
-	case SrvStatSuccess:
-		return "认证成功"
-	case SrvStatFailure:
-		return "认证失败"
-	case SrvStatError:
-		return "内部错误"
-	}
-	return "未知错误"
-}
+// advertisementURL is fetched after a login for the GUI, empty skips it.
+var advertisementURL = "https://raw.githubusercontent.com/tr3ee/go-rjsocks/master/ADVERTISEMENT"
 
 type Service struct {
-	State           SrvStat
+	fsm             stateMachine
 	user, pass      []byte
 	device, adapter string
 	handle          *Handle
-	echoNo, echoKey uint32
-	advertising     string
-	chanPkt         chan gopacket.Packet
-	threadLock      sync.Mutex
 	crontab         *Crontab
-	isClosed        bool
-	isStopped       bool
+	threadLock      sync.Mutex
+	isStopped       atomic.Bool
+	done            chan struct{}
+	closeOnce       sync.Once
+	shutdownOnce    sync.Once
+
+	mu          sync.Mutex // guards the fields below
+	keepAlive   *KeepAlive
+	advertising string
+	staticIP    *IPInfo
+	leasedIP    *IPInfo
+	reportIPv6  bool
+	ipv6        *IPv6Info
+	lastErr     error
+	backoff     BackoffPolicy
+	metrics     *Metrics
+	log         *slog.Logger
+	renewer     Renewer
+	lastRenew   RenewResult
+	// background tracks the renewals and advertisement fetches started by
+	// Run, which waits for them before returning.
+	background sync.WaitGroup
+	hooks      Hooks
+	hooksOnce  sync.Once
+	// cleanup undoes what was set up for the service, e.g. a macvlan.
+	cleanup func()
 }
 
 func NewService(usr, pass, dev, adap string) (*Service, error) {
@@ -72,174 +70,598 @@ func NewService(usr, pass, dev, adap string) (*Service, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewHandleService(usr, pass, dev, adap, hnd), nil
+}
+
+// NewHandleService builds a Service on top of an already opened Handle,
+// e.g. one created with NewTransportHandle.
+func NewHandleService(usr, pass, dev, adap string, hnd *Handle) *Service {
 	return &Service{
 		user:    []byte(usr),
 		pass:    []byte(pass),
 		device:  dev,
 		adapter: adap,
 		handle:  hnd,
-		State:   SrvStatFailure,
-		// chanPkt: make(chan gopacket.Packet, 1024),
 		crontab: NewCrontab(),
-	}, nil
+		done:    make(chan struct{}),
+		backoff: DefaultBackoff,
+		log:     defaultLogger(),
+		renewer: autoRenewer{},
+	}
 }
 
-func (s *Service) packets() (<-chan gopacket.Packet, error) {
-	if s.chanPkt != nil {
-		return s.chanPkt, nil
-	}
-	s.chanPkt = make(chan gopacket.Packet, 1000)
+// packets reads frames until the handle is closed, the EAP ones sent to
+// this session or to a group are passed on. Other sessions sharing the
+// link must not see each other's answers. The returned channel is closed
+// once the reader has exited.
+func (s *Service) packets(ctx context.Context, errc chan<- error) <-chan gopacket.Packet {
+	out := make(chan gopacket.Packet, 64)
+	self := s.handle.SrcMacAddr()
 	go func() {
-		defer close(s.chanPkt)
-		src := gopacket.NewPacketSource(s.handle.PcapHandle, layers.LayerTypeEthernet)
-		in := src.Packets()
-		for packet := range in {
-			if s.isClosed {
-				break
+		defer close(out)
+		for {
+			data, err := s.handle.ReadFrame()
+			if err != nil {
+				if err != io.EOF && err != ErrTransportClosed {
+					errc <- err
+				}
+				return
 			}
-			pkt := packet.Layer(layers.LayerTypeEAP)
-			if pkt == nil {
+			packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+			if packet.Layer(layers.LayerTypeEAP) == nil {
 				continue
 			}
-			s.chanPkt <- packet
+			if eth, ok := packet.LinkLayer().(*layers.Ethernet); ok && len(self) > 0 && eth.DstMAC[0]&1 == 0 && !bytes.Equal(eth.DstMAC, self) {
+				continue
+			}
+			select {
+			case out <- packet:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
-	return s.chanPkt, nil
+	return out
 }
 
-func (s *Service) Run() error {
+// Run authenticates and keeps the session alive until ctx is cancelled or
+// Close is called. Either way it logs off, releases the handle and waits for
+// its goroutines before returning; a Service cannot be run twice.
+func (s *Service) Run(ctx context.Context) (err error) {
 	s.threadLock.Lock()
 	defer s.threadLock.Unlock()
-	go s.crontab.Run()
-	s.crontab.ForceRegister("Monitor", NewCronItem(func() { log.Printf("detect inactive core services, sending start packet\n"); s.handle.SendStartPkt() }, 40*time.Second))
-	in, err := s.packets()
-	if err != nil {
-		return err
+	select {
+	case <-s.done:
+		return ErrServiceClosed
+	default:
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	in := s.packets(ctx, errc)
+	defer func() {
+		cancel()
+		s.background.Wait()
+		s.shutdown()
+		// the reader exits once the handle is closed
+		for range in {
+		}
+	}()
+	go s.crontab.Run(ctx)
+	s.crontab.ForceRegister("Monitor", NewCronItem(func() {
+		// a held session waits for its backoff timer instead
+		if s.isStopped.Load() || s.State() == SrvStatHeld {
+			return
+		}
+		s.logger().Info("authenticator went quiet, sending start packet")
+		s.sendStart()
+	}, 40*time.Second))
+	if s.ReportIPv6() {
+		s.crontab.ForceRegister("IPv6", NewCronItem(s.updateIPv6Info, 30*time.Second))
 	}
-	failcount := int64(0)
-	s.handle.SendStartPkt()
-	for packet := range in {
-		if s.isClosed {
-			break
+	failcount := 0
+	// retry fires the next attempt after a failure, packets keep being
+	// handled while it is pending
+	var retry *time.Timer
+	var retryC <-chan time.Time
+	defer func() {
+		if retry != nil {
+			retry.Stop()
+		}
+	}()
+	s.sendStart()
+	for {
+		var packet gopacket.Packet
+		select {
+		case <-retryC:
+			retryC = nil
+			if err := s.sendStart(); err != nil {
+				s.updateStat(SrvStatError, "sending eapol-start", err)
+				return err
+			}
+			continue
+		case <-s.done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case p, ok := <-in:
+			if !ok {
+				err := ErrTransportClosed
+				select {
+				case err = <-errc:
+				default:
+				}
+				s.updateStat(SrvStatError, "reading frames", err)
+				return err
+			}
+			packet = p
 		}
-		if s.isStopped {
+		if s.isStopped.Load() {
 			s.crontab.UpdateLastAccess("Echo", time.Now())
 			s.crontab.UpdateLastAccess("Monitor", time.Now())
 			continue
 		}
 		eap := packet.Layer(layers.LayerTypeEAP).(*layers.EAP)
+		s.Metrics().incFrame(eap.Code)
 		switch eap.Code {
 		case layers.EAPCodeRequest:
 			switch eap.Type {
 			case layers.EAPTypeIdentity:
-				s.updateStat(SrvStatRespIdentity)
+				if retry != nil {
+					retry.Stop()
+					retryC = nil
+				}
 				eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+				s.updateStat(SrvStatIdentity, "eap-request/identity from "+eth.SrcMAC.String(), nil)
+				s.updateIPInfo()
 				s.handle.SetDstMacAddr(eth.SrcMAC)
 				if err := s.handle.SendResponseIdentity(eap.Id, s.user); err != nil {
+					s.updateStat(SrvStatError, "sending identity", err)
 					return err
 				}
-				log.Printf("response identity '%s' to [%s] with id=%d\n", s.user, s.handle.dstMacAddr, eap.Id)
+				s.logger().Info("answered identity request", "eap_id", eap.Id,
+					"authenticator", eth.SrcMAC.String(), "user", string(s.user))
 			case layers.EAPTypeOTP:
-				s.updateStat(SrvStatRespMd5Chall)
+				s.updateStat(SrvStatChallenge, "eap-request/md5-challenge", nil)
 				if len(eap.TypeData) >= 17 {
 					seed := eap.TypeData[1:17]
 					if err := s.handle.SendResponseMD5Chall(eap.Id, seed, s.user, s.pass); err != nil {
+						s.updateStat(SrvStatError, "sending md5-challenge response", err)
 						return err
 					}
-					log.Printf("response md5-challange with seed=%v\n", seed)
+					s.logger().Debug("answered md5 challenge", "eap_id", eap.Id,
+						"authenticator", s.handle.DstMacAddr().String(), "seed", fmt.Sprintf("%x", seed))
 				}
 			}
 		case layers.EAPCodeSuccess:
-			s.updateStat(SrvStatSuccess)
-			if len(eap.Contents) > 10 {
-				if ok := s.getAdvertisement(eap.Contents); ok {
-					log.Printf("------------- ADVERTISEMENT ------------------\n%s\n", s.advertising)
-					log.Printf("------------------ END -----------------------\n")
-				}
-				go s.getRemoteAdvertisement()
-				pos := int(eap.Contents[9]) + 0x8B
-				if len(eap.Contents) >= pos+4 {
-					key := eap.Contents[pos : pos+4]
-					Symmetric(key)
-					s.echoKey = binary.BigEndian.Uint32(key)
-					s.echoNo = uint32(0x102b)
-					reNewIP(s.adapter)
-					s.crontab.ForceRegister("Echo", NewCronItem(func() {
-						s.updateStat(SrvStatKeepAlive)
-						s.handle.SendEchoPkt(s.echoNo, s.echoKey)
-						s.echoNo++
-					}, 30*time.Second))
-					log.Printf("sending keep-alive packet with no=%x, key=%x...\n", s.echoNo, s.echoKey)
-				}
+			s.setLastError(nil)
+			if s.BackoffPolicy().ResetOnSuccess() {
+				failcount = 0
+			}
+			s.updateStat(SrvStatAuthenticated, "eap-success", nil)
+			s.Metrics().incAuthSuccess()
+			s.background.Add(1)
+			go func() {
+				defer s.background.Done()
+				s.RenewIP(ctx)
+			}()
+			// plain 802.1X sessions need no heartbeat
+			if s.handle.Dialect() == DialectRuijie {
+				s.startKeepAlive(ctx, packet, eap.Id)
 			}
-			log.Printf("A successful login, congraz!\n")
+			s.logger().Info("authenticated", "eap_id", eap.Id, "authenticator", s.handle.DstMacAddr().String())
 		case layers.EAPCodeFailure:
-			log.Printf("login failed, sorry.\n")
-			// 平方退避 0 1 4 9 16 25...
-			s.updateStat(SrvStatFailure)
-			interval := time.Duration(failcount*failcount) * time.Second
-			failcount++
+			reason := ParseFailure(packet.Layer(layers.LayerTypeEAPOL).LayerPayload())
+			s.setLastError(reason)
+			s.Metrics().incAuthFailure(reason)
+			s.logger().Warn("authentication failed", "eap_id", eap.Id,
+				"authenticator", s.handle.DstMacAddr().String(), "err", reason)
+			s.updateStat(SrvStatHeld, "eap-failure", reason)
 			s.crontab.Delete("Echo")
-			time.Sleep(interval)
-			if err := s.handle.SendStartPkt(); err != nil {
+			interval, ok := s.BackoffPolicy().Delay(failcount)
+			failcount++
+			if !ok {
+				err := fmt.Errorf("giving up after %d failed logins: %w", failcount, reason)
+				s.updateStat(SrvStatError, "backoff exhausted", err)
 				return err
 			}
+			s.logger().Info("retrying login", "delay", interval, "attempt", failcount)
+			if retry != nil {
+				retry.Stop()
+			}
+			retry = time.NewTimer(interval)
+			retryC = retry.C
 		}
 	}
-	return nil
+}
+
+// startKeepAlive schedules the Ruijie heartbeat described by an EAP-Success.
+func (s *Service) startKeepAlive(ctx context.Context, packet gopacket.Packet, id uint8) {
+	info, err := ParseSuccess(packet.Layer(layers.LayerTypeEAPOL).LayerPayload())
+	if err != nil {
+		s.logger().Warn("cannot keep the session alive", "eap_id", id, "err", err)
+		return
+	}
+	if len(info.Notice) > 0 {
+		s.mu.Lock()
+		s.advertising = info.Notice
+		s.mu.Unlock()
+		s.logger().Debug("server notice", "notice", info.Notice)
+	}
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.getRemoteAdvertisement(ctx)
+	}()
+	keepAlive := NewKeepAlive(info.EchoKey)
+	s.mu.Lock()
+	s.keepAlive = keepAlive
+	s.mu.Unlock()
+	s.crontab.ForceRegister("Echo", NewCronItem(func() {
+		// a Stop racing with the timer
+		if s.isStopped.Load() {
+			return
+		}
+		s.updateStat(SrvStatKeepAlive, "sending heartbeat", nil)
+		if s.handle.SendEchoPkt(keepAlive) == nil {
+			s.Metrics().incKeepAlive()
+		}
+	}, info.KeepAliveInterval))
+	s.logger().Debug("keep-alive scheduled", "interval", info.KeepAliveInterval,
+		"echo_no", fmt.Sprintf("%x", keepAlive.No()), "echo_key", fmt.Sprintf("%x", keepAlive.Key()))
+}
+
+// LastError returns why the last login failed, nil after a success. Failure
+// reasons wrap ErrBadCredentials, ErrAccountInUse and friends.
+func (s *Service) LastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
+
+func (s *Service) setLastError(err error) {
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
 }
 
 func (s *Service) GetAdvertisement() (ret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if len(s.advertising) == 0 {
 		return "广告被吃掉了，过几分钟再来吧 XD"
 	}
 	return s.advertising
 }
 
-func (s *Service) getAdvertisement(buf []byte) bool {
-	if len(buf) > 10 {
-		length := int(buf[9])
-		if length > 0 {
-			if ad, err := GbkToUtf8(bytes.TrimLeft(buf[10:length+10], "\n\r")); err != nil {
-				return false
-			} else {
-				s.advertising = string(ad)
-				return true
-			}
-		}
+func (s *Service) getRemoteAdvertisement(ctx context.Context) {
+	if len(advertisementURL) == 0 {
+		return
 	}
-	return false
-}
-
-func (s *Service) getRemoteAdvertisement() {
-	resp, err := http.Get(`https://raw.githubusercontent.com/tr3ee/go-rjsocks/master/ADVERTISEMENT`)
-	if err == nil && resp.StatusCode == 200 {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, advertisementURL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 200 {
 		ads, err := ioutil.ReadAll(resp.Body)
 		if err == nil {
+			s.mu.Lock()
 			s.advertising = string(ads) + "\n" + s.advertising
+			s.mu.Unlock()
 		}
 	}
 }
 
-func (s *Service) updateStat(stat SrvStat) {
+// State returns the current state of the supplicant.
+func (s *Service) State() SrvStat {
+	return s.fsm.State()
+}
+
+// Subscribe returns a channel receiving every state transition and a func
+// ending the subscription. The channel is closed when the service closes.
+func (s *Service) Subscribe() (<-chan StateEvent, func()) {
+	return s.fsm.subscribe()
+}
+
+func (s *Service) updateStat(stat SrvStat, cause string, err error) {
 	s.crontab.UpdateLastAccess("Monitor", time.Now())
-	s.State = stat
+	if err := s.fsm.transition(stat, cause, err); err != nil {
+		s.logger().Error("unexpected state transition", "cause", cause, "err", err)
+	}
+	s.Metrics().setState(s.fsm.State())
+}
+
+// SetLogger makes the service, its handle and crontab log to l. Passwords,
+// challenge seeds and keys are redacted and user names masked whatever
+// handler l uses; nil restores the default logger.
+func (s *Service) SetLogger(l *slog.Logger) {
+	l = redactLogger(l)
+	s.mu.Lock()
+	s.log = l
+	s.mu.Unlock()
+	s.handle.SetLogger(l)
+	s.crontab.SetLogger(l)
+}
+
+// logger returns the service logger carrying the adapter and current state.
+func (s *Service) logger() *slog.Logger {
+	s.mu.Lock()
+	l := s.log
+	s.mu.Unlock()
+	return l.With("adapter", s.adapter, "state", s.State().Name())
+}
+
+// SetBackoffPolicy sets how failed logins are retried, nil restores
+// DefaultBackoff.
+func (s *Service) SetBackoffPolicy(p BackoffPolicy) {
+	if p == nil {
+		p = DefaultBackoff
+	}
+	s.mu.Lock()
+	s.backoff = p
+	s.mu.Unlock()
+}
+
+func (s *Service) BackoffPolicy() BackoffPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backoff
+}
+
+// SetMetrics makes the service and its handle count into m, which can then
+// be exposed with ServeMetrics.
+func (s *Service) SetMetrics(m *Metrics) {
+	s.mu.Lock()
+	s.metrics = m
+	s.mu.Unlock()
+	s.handle.SetMetrics(m)
+	m.setState(s.State())
+}
+
+func (s *Service) Metrics() *Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metrics
+}
+
+// SetDialect selects the 802.1X flavour, DialectRuijie by default.
+func (s *Service) SetDialect(d Dialect) {
+	s.handle.SetDialect(d)
+}
+
+func (s *Service) Dialect() Dialect {
+	return s.handle.Dialect()
+}
+
+// SetGroupAddr overrides the multicast address of the dialect, see
+// Handle.SetGroupAddr.
+func (s *Service) SetGroupAddr(addr net.HardwareAddr) error {
+	return s.handle.SetGroupAddr(addr)
+}
+
+// SetRenewer sets how the adapter's IP is renewed after each successful
+// login, nil restores RenewAuto. A Renewer that is an io.Closer is closed
+// when it is replaced or with the service.
+func (s *Service) SetRenewer(r Renewer) {
+	if r == nil {
+		r = autoRenewer{}
+	}
+	s.mu.Lock()
+	old := s.renewer
+	s.renewer = r
+	s.mu.Unlock()
+	if old == r {
+		return
+	}
+	if _, ok := old.(leaser); ok {
+		s.crontab.Delete("DHCP")
+	}
+	if c, ok := old.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (s *Service) Renewer() Renewer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.renewer
+}
+
+// RenewIP renews the adapter's IP with the configured Renewer and waits for
+// it to finish. The outcome is also kept for LastRenew.
+func (s *Service) RenewIP(ctx context.Context) error {
+	r := s.Renewer()
+	start := time.Now()
+	err := r.Renew(ctx, s.adapter)
+	res := RenewResult{Method: r.Method(), Time: start, Duration: time.Since(start), Err: err}
+	s.mu.Lock()
+	s.lastRenew = res
+	s.mu.Unlock()
+	if err != nil {
+		s.logger().Warn("cannot renew ip", "method", res.Method, "err", err)
+	} else {
+		s.logger().Info("ip renewed", "method", res.Method, "took", res.Duration)
+	}
+	if l, ok := r.(leaser); ok {
+		s.applyLease(ctx, l.Lease(), err)
+	}
+	return err
+}
+
+// applyLease reports a lease of the built-in DHCP client to the
+// authenticator and schedules its renewal.
+func (s *Service) applyLease(ctx context.Context, lease *Lease, err error) {
+	delay := dhcpRetryInterval
+	if lease != nil {
+		s.mu.Lock()
+		s.leasedIP = lease.IPInfo()
+		s.mu.Unlock()
+		s.updateIPInfo()
+		if err == nil {
+			delay = time.Until(lease.Obtained.Add(lease.T1))
+		}
+	}
+	s.crontab.ForceRegister("DHCP", NewOneShotCronItem(func() {
+		s.RenewIP(ctx)
+	}, delay))
+}
+
+// EnableDHCP makes the service obtain the adapter's address with its own
+// DHCP client after each login. conf applies the leases to the system, nil
+// only reports them to the authenticator.
+func (s *Service) EnableDHCP(conf Configurator) error {
+	dev, err := SelectNetworkDev(s.device)
+	if err != nil {
+		return err
+	}
+	c, err := NewDHCPClient(dev, s.handle.SrcMacAddr(), conf)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	c.SetLogger(s.log)
+	s.mu.Unlock()
+	s.SetRenewer(c)
+	return nil
+}
+
+// LastRenew returns the outcome of the last IP renewal, its Time is zero if
+// none happened yet.
+func (s *Service) LastRenew() RenewResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastRenew
+}
+
+// SetStaticIPInfo makes the service report info instead of the adapter's
+// live configuration. Passing nil goes back to reading the adapter.
+func (s *Service) SetStaticIPInfo(info *IPInfo) {
+	s.mu.Lock()
+	s.staticIP = info
+	s.mu.Unlock()
+}
+
+// SetReportIPv6 makes the service report the adapter's link-local, temporary
+// and global IPv6 addresses. They are re-read every 30 seconds and before
+// each authentication.
+func (s *Service) SetReportIPv6(enable bool) {
+	s.mu.Lock()
+	s.reportIPv6 = enable
+	s.mu.Unlock()
+}
+
+func (s *Service) ReportIPv6() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reportIPv6
+}
+
+func (s *Service) updateIPv6Info() {
+	if !s.ReportIPv6() {
+		return
+	}
+	info, err := LookupIPv6Info(s.adapter)
+	if err != nil {
+		s.logger().Warn("cannot read ipv6 addresses", "err", err)
+		return
+	}
+	s.mu.Lock()
+	changed := !info.Equal(s.ipv6)
+	s.ipv6 = info
+	s.mu.Unlock()
+	if !changed {
+		return
+	}
+	s.logger().Info("ipv6 addresses changed", "ipv6", info.String())
+	s.handle.UpdateTrailer(func(t *Trailer) {
+		t.Attributes = info.apply(t.Attributes)
+	})
+}
+
+// updateIPInfo refreshes the address block sent in front of the trailer.
+func (s *Service) updateIPInfo() {
+	s.updateIPv6Info()
+	s.mu.Lock()
+	info := s.staticIP
+	if info == nil {
+		info = s.leasedIP
+	}
+	s.mu.Unlock()
+	if info == nil {
+		var err error
+		if info, err = LookupIPInfo(s.adapter); err != nil {
+			s.logger().Warn("cannot read ip info", "err", err)
+			if info == nil {
+				return
+			}
+		}
+	}
+	s.handle.UpdateTrailer(func(t *Trailer) {
+		t.IPInfo = *info
+	})
+}
+
+func (s *Service) sendStart() error {
+	s.updateStat(SrvStatConnecting, "sending eapol-start", nil)
+	s.updateIPInfo()
+	s.Metrics().incAuthAttempt()
+	return s.handle.SendStartPkt()
 }
 
 func (s *Service) Continue() {
-	s.isStopped = false
-	s.handle.SendStartPkt()
+	s.isStopped.Store(false)
+	s.sendStart()
 }
 
+// Stop logs off and ends the heartbeat until Continue or Reauth.
 func (s *Service) Stop() {
-	s.isStopped = true
+	s.isStopped.Store(true)
+	s.crontab.Delete("Echo")
 	s.handle.SendLogoffPkt()
+	s.updateStat(SrvStatLoggedOff, "stopped", nil)
 }
 
-func (s *Service) Close() {
-	log.Printf("closing RJSocks service\n")
+// Reauth logs off and authenticates again, e.g. after the machine slept.
+func (s *Service) Reauth() error {
+	s.isStopped.Store(false)
+	s.crontab.Delete("Echo")
 	s.handle.SendLogoffPkt()
-	s.handle.Close()
-	s.crontab.Close()
-	s.isClosed = true
+	s.updateStat(SrvStatLoggedOff, "reauthenticating", nil)
+	return s.sendStart()
+}
+
+// Close stops a running Run and waits for it to clean up. It is safe to call
+// more than once and from any goroutine.
+func (s *Service) Close() {
+	s.closeOnce.Do(func() {
+		s.logger().Info("closing service")
+		close(s.done)
+	})
+	s.threadLock.Lock()
+	defer s.threadLock.Unlock()
+	s.shutdown()
+}
+
+// shutdown logs off and releases everything, only the first call counts.
+func (s *Service) shutdown() {
+	s.shutdownOnce.Do(func() {
+		if s.State() != SrvStatLoggedOff {
+			s.handle.SendLogoffPkt()
+		}
+		s.handle.Close()
+		s.crontab.Close()
+		if c, ok := s.Renewer().(io.Closer); ok {
+			c.Close()
+		}
+		s.updateStat(SrvStatLoggedOff, "closed", nil)
+		s.fsm.close()
+		clear(s.pass)
+		if s.cleanup != nil {
+			s.cleanup()
+		}
+	})
 }
@@ -0,0 +1,441 @@
+package rjsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/transform"
+)
+
+func TestMain(m *testing.M) {
+	// keep the tests off the network
+	advertisementURL = ""
+	os.Exit(m.Run())
+}
+
+var (
+	testHostMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testAuthMAC = net.HardwareAddr{0x00, 0x1a, 0xa9, 0x00, 0x00, 0x01}
+)
+
+// testAuthenticator plays the switch at the far end of a pipe.
+type testAuthenticator struct {
+	t      *testing.T
+	tr     Transport
+	frames chan gopacket.Packet
+}
+
+// newTestService returns a Service on a pipe that neither touches the
+// host's addresses nor runs a renewal command.
+func newTestService(t *testing.T) (*Service, *testAuthenticator) {
+	t.Helper()
+	host, auth := NewPipe()
+	s := NewHandleService("2017xxxx", "secret", "test0", "test0", NewTransportHandle(host, testHostMAC))
+	s.SetRenewer(noneRenewer{})
+	s.SetStaticIPInfo(&IPInfo{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32), Gateway: net.IPv4(10, 0, 0, 1)})
+	a := &testAuthenticator{t: t, tr: auth, frames: make(chan gopacket.Packet, 64)}
+	go func() {
+		defer close(a.frames)
+		for {
+			data, err := auth.ReadFrame()
+			if err != nil {
+				return
+			}
+			a.frames <- gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		}
+	}()
+	t.Cleanup(s.Close)
+	return s, a
+}
+
+// eapFrame builds an EAP packet from the test authenticator, extra follows
+// the EAP body like the Ruijie private data does. The EAP header is written
+// by hand as gopacket drops the type of requests without type data.
+func eapFrame(code layers.EAPCode, id uint8, typ layers.EAPType, typeData, extra []byte) ([]byte, error) {
+	body := []byte{byte(code), id, 0, eapHeaderLen}
+	if code == layers.EAPCodeRequest || code == layers.EAPCodeResponse {
+		body = append(append(body, byte(typ)), typeData...)
+		binary.BigEndian.PutUint16(body[2:], uint16(len(body)))
+	}
+	eth := layers.Ethernet{SrcMAC: testAuthMAC, DstMAC: testHostMAC, EthernetType: layers.EthernetTypeEAPOL}
+	eapol := layers.EAPOL{Version: 1, Type: layers.EAPOLTypeEAP, Length: uint16(len(body))}
+	payload := gopacket.Payload(append(body, extra...))
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, &eth, &eapol, &payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// successPayload builds the Ruijie data following the header of an
+// EAP-Success: the notice, the echo key and attrs.
+func successPayload(notice []byte, key uint32, attrs Attributes) []byte {
+	buf := make([]byte, len(notice)+successKeyOff+4-eapHeaderLen)
+	buf[successNoticeLenOff-eapHeaderLen] = byte(len(notice))
+	copy(buf[successNoticeOff-eapHeaderLen:], notice)
+	k := buf[len(buf)-4:]
+	binary.BigEndian.PutUint32(k, key)
+	Symmetric(k)
+	buf, err := attrs.appendTo(buf)
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// send writes an EAP packet to the supplicant.
+func (a *testAuthenticator) send(code layers.EAPCode, id uint8, typ layers.EAPType, typeData, extra []byte) {
+	a.t.Helper()
+	frame, err := eapFrame(code, id, typ, typeData, extra)
+	if err == nil {
+		err = a.tr.WriteFrame(frame)
+	}
+	if err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+// next returns the next frame of the supplicant with the given EAPOL type.
+func (a *testAuthenticator) next(typ layers.EAPOLType) gopacket.Packet {
+	a.t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case p, ok := <-a.frames:
+			if !ok {
+				a.t.Fatalf("pipe closed while waiting for %v", typ)
+			}
+			eapol, _ := p.Layer(layers.LayerTypeEAPOL).(*layers.EAPOL)
+			if eapol != nil && eapol.Type == typ {
+				return p
+			}
+		case <-timeout:
+			a.t.Fatalf("no %v frame within 2s", typ)
+		}
+	}
+}
+
+// response returns the next EAP-Response of the supplicant, its type data
+// cut to the EAP length as gopacket leaves the trailer in.
+func (a *testAuthenticator) response() *layers.EAP {
+	a.t.Helper()
+	eap, _ := a.next(layers.EAPOLTypeEAP).Layer(layers.LayerTypeEAP).(*layers.EAP)
+	if eap == nil || eap.Code != layers.EAPCodeResponse {
+		a.t.Fatalf("want an EAP-Response, got %v", eap)
+	}
+	if n := int(eap.Length) - eapHeaderLen - 1; n >= 0 && n <= len(eap.TypeData) {
+		eap.TypeData = eap.TypeData[:n]
+	}
+	return eap
+}
+
+// waitGoroutines fails unless the goroutine count drops to want.
+func waitGoroutines(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left, want %d\n%s", runtime.NumGoroutine(), want, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServiceConcurrentControl(t *testing.T) {
+	before := runtime.NumGoroutine()
+	s, a := newTestService(t)
+	// answer every start so the controls race with a live exchange
+	go func() {
+		for p := range a.frames {
+			if eapol, _ := p.Layer(layers.LayerTypeEAPOL).(*layers.EAPOL); eapol != nil && eapol.Type == layers.EAPOLTypeStart {
+				frame, _ := eapFrame(layers.EAPCodeRequest, 1, layers.EAPTypeIdentity, nil, nil)
+				a.tr.WriteFrame(frame)
+			}
+		}
+	}()
+	done := make(chan error, 1)
+	go func() { done <- s.Run(context.Background()) }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				switch (i + j) % 4 {
+				case 0:
+					s.Stop()
+				case 1:
+					s.Continue()
+				case 2:
+					s.Reauth()
+				default:
+					s.Status()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned %v after Close", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+	if err := s.Run(context.Background()); err != ErrServiceClosed {
+		t.Fatalf("second Run returned %v, want ErrServiceClosed", err)
+	}
+	if s.State() != SrvStatLoggedOff {
+		t.Fatalf("state %v after Close", s.State())
+	}
+	waitGoroutines(t, before)
+}
+
+func TestServiceRunCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	s, a := newTestService(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	a.next(layers.EAPOLTypeStart)
+	a.send(layers.EAPCodeRequest, 1, layers.EAPTypeIdentity, nil, nil)
+	a.response()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	a.next(layers.EAPOLTypeLogOff)
+	waitGoroutines(t, before)
+}
+
+func TestServicePipeExchange(t *testing.T) {
+	s, a := newTestService(t)
+	clock := newFakeClock()
+	s.crontab = NewClockCrontab(clock)
+	events, cancel := s.Subscribe()
+	defer cancel()
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	expect := func(want SrvStat) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.To != want {
+				t.Fatalf("moved to %v (%s), want %v", ev.To, ev.Cause, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no transition to %v", want)
+		}
+	}
+
+	a.next(layers.EAPOLTypeStart)
+	expect(SrvStatConnecting)
+
+	a.send(layers.EAPCodeRequest, 1, layers.EAPTypeIdentity, nil, nil)
+	expect(SrvStatIdentity)
+	eap := a.response()
+	if eap.Id != 1 || eap.Type != layers.EAPTypeIdentity || string(eap.TypeData) != "2017xxxx" {
+		t.Fatalf("identity response %d/%v %q", eap.Id, eap.Type, eap.TypeData)
+	}
+
+	salt := bytes.Repeat([]byte{0xa5}, 16)
+	a.send(layers.EAPCodeRequest, 2, layers.EAPTypeOTP, append([]byte{16}, salt...), nil)
+	expect(SrvStatChallenge)
+	eap = a.response()
+	sum := md5.Sum(append(append([]byte{2}, "secret"...), salt...))
+	if eap.Id != 2 || eap.Type != layers.EAPTypeOTP || eap.TypeData[0] != 16 ||
+		!bytes.Equal(eap.TypeData[1:17], sum[:]) || string(eap.TypeData[17:]) != "2017xxxx" {
+		t.Fatalf("md5 response %d/%v % x", eap.Id, eap.Type, eap.TypeData)
+	}
+
+	// "欢迎" in GBK
+	a.send(layers.EAPCodeSuccess, 2, 0, nil, successPayload([]byte{0xbb, 0xb6, 0xd3, 0xad}, 0x540c, nil))
+	expect(SrvStatAuthenticated)
+	deadline := time.Now().Add(2 * time.Second)
+	for !s.crontab.Exist("Echo") {
+		if time.Now().After(deadline) {
+			t.Fatal("keep-alive not scheduled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := s.GetAdvertisement(); got != "欢迎" {
+		t.Fatalf("notice %q", got)
+	}
+
+	clock.Advance(DefaultKeepAliveInterval)
+	expect(SrvStatKeepAlive)
+	echo := a.next(0xbf).Layer(layers.LayerTypeEAPOL).LayerPayload()
+	if !bytes.Equal(echo[:len(officialEcho)], officialEcho) {
+		t.Fatalf("heartbeat\n% x, want\n% x", echo, officialEcho)
+	}
+
+	stop()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Run returned %v, want context.Canceled", err)
+	}
+	a.next(layers.EAPOLTypeLogOff)
+	expect(SrvStatLoggedOff)
+}
+
+// gbk encodes s like the authenticator messages.
+func gbk(t *testing.T, s string) []byte {
+	t.Helper()
+	buf, _, err := transform.Bytes(simplifiedchinese.GBK.NewEncoder(), []byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// login answers the identity request id and the md5 challenge id+1.
+func (a *testAuthenticator) login(id uint8) {
+	a.t.Helper()
+	a.send(layers.EAPCodeRequest, id, layers.EAPTypeIdentity, nil, nil)
+	a.response()
+	a.send(layers.EAPCodeRequest, id+1, layers.EAPTypeOTP, append([]byte{16}, make([]byte, 16)...), nil)
+	a.response()
+}
+
+// syncBuffer collects log output from several goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// authenticated runs s over a fake clock up to its first heartbeat.
+func authenticated(t *testing.T) (*Service, *testAuthenticator, *fakeClock, *syncBuffer) {
+	t.Helper()
+	s, a := newTestService(t)
+	clock := newFakeClock()
+	s.crontab = NewClockCrontab(clock)
+	logs := new(syncBuffer)
+	s.SetLogger(slog.New(slog.NewTextHandler(logs, nil)))
+	s.SetBackoffPolicy(ExponentialBackoff(time.Hour, time.Hour))
+	ctx, stop := context.WithCancel(context.Background())
+	t.Cleanup(stop)
+	go s.Run(ctx)
+	a.next(layers.EAPOLTypeStart)
+	a.login(1)
+	a.send(layers.EAPCodeSuccess, 2, 0, nil, successPayload(nil, 0x540c, nil))
+	deadline := time.Now().Add(2 * time.Second)
+	for !s.crontab.Exist("Echo") {
+		if time.Now().After(deadline) {
+			t.Fatal("keep-alive not scheduled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(DefaultKeepAliveInterval)
+	a.next(0xbf)
+	return s, a, clock, logs
+}
+
+func TestServiceStopEndsKeepAlive(t *testing.T) {
+	s, a, clock, logs := authenticated(t)
+	s.Stop()
+	a.next(layers.EAPOLTypeLogOff)
+	if s.crontab.Exist("Echo") {
+		t.Fatal("heartbeat still scheduled after Stop")
+	}
+	for i := 0; i < 3; i++ {
+		clock.Advance(DefaultKeepAliveInterval)
+	}
+	select {
+	case p := <-a.frames:
+		t.Fatalf("frame sent after Stop: %v", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if s.State() != SrvStatLoggedOff {
+		t.Fatalf("state %v after Stop", s.State())
+	}
+	if strings.Contains(logs.String(), "unexpected state transition") {
+		t.Fatalf("bad transition logged:\n%s", logs)
+	}
+}
+
+func TestServiceRepeatedFailure(t *testing.T) {
+	s, a, _, logs := authenticated(t)
+	msg := successPayload(gbk(t, "密码错误"), 0, nil)
+	a.send(layers.EAPCodeFailure, 3, 0, nil, msg)
+	a.send(layers.EAPCodeFailure, 3, 0, nil, msg)
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), "retrying login") || strings.Count(logs.String(), "authentication failed") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("failures not handled:\n%s", logs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s.State() != SrvStatHeld || !errors.Is(s.LastError(), ErrBadCredentials) {
+		t.Fatalf("state %v, last error %v", s.State(), s.LastError())
+	}
+	if s.crontab.Exist("Echo") {
+		t.Fatal("heartbeat still scheduled after a failure")
+	}
+	if strings.Contains(logs.String(), "unexpected state transition") {
+		t.Fatalf("bad transition logged:\n%s", logs)
+	}
+}
+
+// closingRenewer counts how often it was closed.
+type closingRenewer struct {
+	noneRenewer
+	closed int
+}
+
+func (r *closingRenewer) Close() error {
+	r.closed++
+	return nil
+}
+
+func TestServiceSetRenewerCloses(t *testing.T) {
+	s, _ := newTestService(t)
+	a, b := new(closingRenewer), new(closingRenewer)
+	s.SetRenewer(a)
+	s.SetRenewer(a)
+	if a.closed != 0 {
+		t.Fatal("renewer closed when set again")
+	}
+	s.SetRenewer(b)
+	if a.closed != 1 || b.closed != 0 {
+		t.Fatalf("replaced renewer closed %d times, new one %d", a.closed, b.closed)
+	}
+	s.Close()
+	if a.closed != 1 || b.closed != 1 {
+		t.Fatalf("after Close: replaced renewer closed %d times, current one %d", a.closed, b.closed)
+	}
+}
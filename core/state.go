@@ -0,0 +1,198 @@
+package rjsocks
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type SrvStat int
+
+const (
+	// SrvStatLoggedOff is the initial state, and the state after Stop.
+	SrvStatLoggedOff = SrvStat(iota)
+	// SrvStatConnecting means an EAPOL-Start was sent.
+	SrvStatConnecting
+	SrvStatIdentity
+	SrvStatChallenge
+	SrvStatAuthenticated
+	SrvStatKeepAlive
+	// SrvStatHeld follows an EAP-Failure until the next attempt.
+	SrvStatHeld
+	SrvStatError
+)
+
+func (s SrvStat) String() string {
+	switch s {
+	case SrvStatLoggedOff:
+		return "已断开"
+	case SrvStatConnecting:
+		return "请求认证..."
+	case SrvStatIdentity:
+		return "开始认证..."
+	case SrvStatChallenge:
+		return "认证中..."
+	case SrvStatKeepAlive:
+		return "保持认证状态"
+	case SrvStatAuthenticated:
+		return "认证成功"
+	case SrvStatHeld:
+		return "认证失败"
+	case SrvStatError:
+		return "内部错误"
+	}
+	return "未知错误"
+}
+
+// Name returns a stable ASCII name of the state for logs, metrics and
+// machine readable output.
+func (s SrvStat) Name() string {
+	switch s {
+	case SrvStatLoggedOff:
+		return "logged_off"
+	case SrvStatConnecting:
+		return "connecting"
+	case SrvStatIdentity:
+		return "identity"
+	case SrvStatChallenge:
+		return "challenge"
+	case SrvStatAuthenticated:
+		return "authenticated"
+	case SrvStatKeepAlive:
+		return "keep_alive"
+	case SrvStatHeld:
+		return "held"
+	case SrvStatError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Online reports whether the session is authenticated.
+func (s SrvStat) Online() bool {
+	return s == SrvStatAuthenticated || s == SrvStatKeepAlive
+}
+
+// srvTransitions lists the states reachable from each state. Any state may
+// move to SrvStatLoggedOff or SrvStatError.
+var srvTransitions = map[SrvStat][]SrvStat{
+	SrvStatLoggedOff:     {SrvStatConnecting},
+	SrvStatConnecting:    {SrvStatConnecting, SrvStatIdentity, SrvStatHeld},
+	SrvStatIdentity:      {SrvStatConnecting, SrvStatIdentity, SrvStatChallenge, SrvStatAuthenticated, SrvStatHeld},
+	SrvStatChallenge:     {SrvStatConnecting, SrvStatIdentity, SrvStatChallenge, SrvStatAuthenticated, SrvStatHeld},
+	SrvStatAuthenticated: {SrvStatConnecting, SrvStatIdentity, SrvStatKeepAlive, SrvStatHeld},
+	SrvStatKeepAlive:     {SrvStatConnecting, SrvStatIdentity, SrvStatKeepAlive, SrvStatAuthenticated, SrvStatHeld},
+	SrvStatHeld:          {SrvStatConnecting, SrvStatIdentity, SrvStatHeld},
+	SrvStatError:         {SrvStatConnecting},
+}
+
+// StateEvent describes a transition of the service state.
+type StateEvent struct {
+	Time     time.Time
+	From, To SrvStat
+	// Cause says what triggered the transition.
+	Cause string
+	// Err is set when entering SrvStatHeld or SrvStatError.
+	Err error
+}
+
+func (e StateEvent) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v -> %v (%s: %v)", e.From, e.To, e.Cause, e.Err)
+	}
+	return fmt.Sprintf("%v -> %v (%s)", e.From, e.To, e.Cause)
+}
+
+// stateMachine guards the service state and fans transitions out to the
+// subscribers. Slow subscribers miss events instead of blocking the service.
+type stateMachine struct {
+	mu     sync.Mutex
+	state  SrvStat
+	last   StateEvent
+	subs   map[chan StateEvent]struct{}
+	closed bool
+}
+
+func (m *stateMachine) State() SrvStat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// transition moves to state to. Staying in the same state is allowed where
+// listed but does not notify subscribers.
+func (m *stateMachine) transition(to SrvStat, cause string, err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from := m.state
+	if !canTransition(from, to) {
+		return fmt.Errorf("invalid state transition %v -> %v (%s)", from, to, cause)
+	}
+	m.state = to
+	if from == to {
+		return nil
+	}
+	ev := StateEvent{Time: time.Now(), From: from, To: to, Cause: cause, Err: err}
+	m.last = ev
+	for ch := range m.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	return nil
+}
+
+// lastEvent returns the transition into the current state, zero before the
+// first one.
+func (m *stateMachine) lastEvent() StateEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+func canTransition(from, to SrvStat) bool {
+	if to == SrvStatLoggedOff || to == SrvStatError {
+		return true
+	}
+	for _, s := range srvTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *stateMachine) subscribe() (<-chan StateEvent, func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := make(chan StateEvent, 16)
+	if m.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if m.subs == nil {
+		m.subs = make(map[chan StateEvent]struct{})
+	}
+	m.subs[ch] = struct{}{}
+	cancel := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.subs[ch]; ok {
+			delete(m.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// close ends every subscription, later subscriptions get a closed channel.
+func (m *stateMachine) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ch := range m.subs {
+		close(ch)
+	}
+	m.subs = nil
+	m.closed = true
+}
@@ -0,0 +1,58 @@
+package rjsocks
+
+import "time"
+
+// Status is a snapshot of a Service meant for status files and control
+// clients, hence the plain JSON friendly fields.
+type Status struct {
+	Device        string       `json:"device"`
+	Adapter       string       `json:"adapter"`
+	User          string       `json:"user"`
+	State         string       `json:"state"`
+	Online        bool         `json:"online"`
+	Since         time.Time    `json:"since"`
+	Cause         string       `json:"cause,omitempty"`
+	Error         string       `json:"error,omitempty"`
+	Authenticator string       `json:"authenticator,omitempty"`
+	Dialect       Dialect      `json:"dialect"`
+	Renew         *RenewStatus `json:"renew,omitempty"`
+}
+
+// RenewStatus is the outcome of the last IP renewal.
+type RenewStatus struct {
+	Method string    `json:"method"`
+	Time   time.Time `json:"time"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Status returns a snapshot of the service. Error holds the last failure
+// reason, the cause of an error state otherwise.
+func (s *Service) Status() Status {
+	ev := s.fsm.lastEvent()
+	state := s.State()
+	st := Status{
+		Device:  s.device,
+		Adapter: s.adapter,
+		User:    string(s.user),
+		State:   state.Name(),
+		Online:  state.Online(),
+		Since:   ev.Time,
+		Cause:   ev.Cause,
+		Dialect: s.handle.Dialect(),
+	}
+	if err := s.LastError(); err != nil {
+		st.Error = err.Error()
+	} else if ev.Err != nil {
+		st.Error = ev.Err.Error()
+	}
+	if addr := s.handle.authenticator(); addr != nil {
+		st.Authenticator = addr.String()
+	}
+	if r := s.LastRenew(); !r.Time.IsZero() {
+		st.Renew = &RenewStatus{Method: r.Method, Time: r.Time}
+		if r.Err != nil {
+			st.Renew.Error = r.Err.Error()
+		}
+	}
+	return st
+}
@@ -0,0 +1,100 @@
+package rjsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultKeepAliveInterval is the heartbeat period used by the official client.
+var DefaultKeepAliveInterval = 30 * time.Second
+
+const (
+	successNoticeLenOff = 9
+	successNoticeOff    = 10
+	// successKeyOff is the offset of the echo key past the notice.
+	successKeyOff = 0x8B
+)
+
+var (
+	ErrTruncatedSuccess = errors.New("truncated eap-success frame")
+	ErrBadNotice        = errors.New("undecodable server notice")
+)
+
+// SuccessInfo is the Ruijie payload of an EAP-Success frame.
+type SuccessInfo struct {
+	// Notice is the server message shown to users, decoded from GBK.
+	Notice string
+	// EchoKey seeds the heartbeat counter, see KeepAlive.
+	EchoKey uint32
+	// KeepAliveInterval is the heartbeat period sent by the authenticator,
+	// DefaultKeepAliveInterval if it sent none.
+	KeepAliveInterval time.Duration
+	// Attributes holds the vendor attributes found after the notice.
+	Attributes Attributes
+}
+
+// ParseSuccess decodes an EAP-Success frame starting at the EAP header.
+func ParseSuccess(buf []byte) (*SuccessInfo, error) {
+	notice, err := parseNotice(buf)
+	if err != nil {
+		return nil, err
+	}
+	noticeLen := int(buf[successNoticeLenOff])
+	info := &SuccessInfo{Notice: notice, KeepAliveInterval: DefaultKeepAliveInterval}
+	pos := noticeLen + successKeyOff
+	if len(buf) < pos+4 {
+		return nil, fmt.Errorf("%w: echo key at %d, have %d bytes", ErrTruncatedSuccess, pos, len(buf))
+	}
+	key := make([]byte, 4)
+	copy(key, buf[pos:pos+4])
+	Symmetric(key)
+	info.EchoKey = binary.BigEndian.Uint32(key)
+	info.Attributes = scanAttributes(buf[successNoticeOff+noticeLen:])
+	if v, ok := info.Attributes.Get(AttrKeepAlive); ok {
+		if len(v) != 4 || binary.BigEndian.Uint32(v) == 0 {
+			return nil, fmt.Errorf("%w: keep-alive interval % x", ErrBadAttribute, v)
+		}
+		info.KeepAliveInterval = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	return info, nil
+}
+
+// parseNotice decodes the GBK server message found in Success and Failure
+// frames.
+func parseNotice(buf []byte) (string, error) {
+	if len(buf) <= successNoticeLenOff {
+		return "", fmt.Errorf("%w: %d bytes", ErrTruncatedSuccess, len(buf))
+	}
+	noticeLen := int(buf[successNoticeLenOff])
+	if len(buf) < successNoticeOff+noticeLen {
+		return "", fmt.Errorf("%w: notice needs %d bytes, have %d", ErrTruncatedSuccess, noticeLen, len(buf)-successNoticeOff)
+	}
+	if noticeLen == 0 {
+		return "", nil
+	}
+	notice, err := GbkToUtf8(bytes.TrimLeft(buf[successNoticeOff:successNoticeOff+noticeLen], "\n\r"))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrBadNotice, err)
+	}
+	return string(bytes.TrimRight(notice, "\x00")), nil
+}
+
+// scanAttributes collects every well formed vendor attribute in buf. The
+// fields between them are undocumented and skipped.
+func scanAttributes(buf []byte) Attributes {
+	var ret Attributes
+	for p := 0; p+attrHeaderLen <= len(buf); p++ {
+		n := int(buf[p+1])
+		if buf[p] != attrMagic || n < attrHeaderLen || p+n > len(buf) || int(buf[p+7]) != n-6 || !bytes.Equal(buf[p+2:p+6], ruijieVendor) {
+			continue
+		}
+		value := make([]byte, n-attrHeaderLen)
+		copy(value, buf[p+attrHeaderLen:p+n])
+		ret = append(ret, Attribute{Type: AttrType(buf[p+6]), Value: value})
+		p += n - 1
+	}
+	return ret
+}
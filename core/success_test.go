@@ -0,0 +1,75 @@
+package rjsocks
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// successBody is an EAP-Success from its header on.
+func successBody(payload []byte) []byte {
+	return append([]byte{3, 2, 0, eapHeaderLen}, payload...)
+}
+
+func TestParseSuccess(t *testing.T) {
+	interval := func(sec byte) Attribute {
+		return Attribute{Type: AttrKeepAlive, Value: []byte{0, 0, 0, sec}}
+	}
+	status := Attribute{Type: AttrStatus, Value: []byte{0, 0, 0, 1}}
+	for _, tc := range []struct {
+		name     string
+		notice   []byte
+		attrs    Attributes
+		notice8  string
+		interval time.Duration
+	}{
+		{"bare", nil, nil, "", DefaultKeepAliveInterval},
+		{"notice", gbk(t, "\r\n欢迎使用\x00\x00"), nil, "欢迎使用", DefaultKeepAliveInterval},
+		{"attributes", nil, Attributes{status}, "", DefaultKeepAliveInterval},
+		{"interval", gbk(t, "欢迎"), Attributes{status, interval(60)}, "欢迎", time.Minute},
+	} {
+		info, err := ParseSuccess(successBody(successPayload(tc.notice, 0x540c, tc.attrs)))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if info.Notice != tc.notice8 || info.EchoKey != 0x540c || info.KeepAliveInterval != tc.interval {
+			t.Errorf("%s: got %q/%#x/%v", tc.name, info.Notice, info.EchoKey, info.KeepAliveInterval)
+		}
+		if len(info.Attributes) != len(tc.attrs) {
+			t.Errorf("%s: attributes %+v, want %+v", tc.name, info.Attributes, tc.attrs)
+		}
+		for i := range tc.attrs {
+			if i < len(info.Attributes) && (info.Attributes[i].Type != tc.attrs[i].Type || !bytes.Equal(info.Attributes[i].Value, tc.attrs[i].Value)) {
+				t.Errorf("%s: attribute %d is %+v, want %+v", tc.name, i, info.Attributes[i], tc.attrs[i])
+			}
+		}
+	}
+}
+
+func TestParseSuccessMalformed(t *testing.T) {
+	full := successBody(successPayload(gbk(t, "欢迎"), 0x540c, nil))
+	longNotice := append([]byte(nil), full...)
+	longNotice[successNoticeLenOff] = 0xff
+	for _, tc := range []struct {
+		name string
+		buf  []byte
+		want error
+	}{
+		{"empty", nil, ErrTruncatedSuccess},
+		{"header only", full[:eapHeaderLen], ErrTruncatedSuccess},
+		{"no notice length", full[:successNoticeLenOff], ErrTruncatedSuccess},
+		{"cut notice", full[:successNoticeOff+2], ErrTruncatedSuccess},
+		{"notice past the end", longNotice, ErrTruncatedSuccess},
+		{"no echo key", full[:len(full)-4], ErrTruncatedSuccess},
+		{"cut echo key", full[:len(full)-1], ErrTruncatedSuccess},
+		{"short interval", successBody(successPayload(nil, 1, Attributes{{Type: AttrKeepAlive, Value: []byte{0, 30}}})), ErrBadAttribute},
+		{"zero interval", successBody(successPayload(nil, 1, Attributes{{Type: AttrKeepAlive, Value: []byte{0, 0, 0, 0}}})), ErrBadAttribute},
+	} {
+		info, err := ParseSuccess(tc.buf)
+		if !errors.Is(err, tc.want) || info != nil {
+			t.Errorf("%s: got %+v, %v, want %v", tc.name, info, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package rjsocks
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// Transport sends and receives raw Ethernet frames on behalf of a Handle.
+type Transport interface {
+	// ReadFrame blocks until a frame arrives. Once the transport is closed
+	// it returns io.EOF.
+	ReadFrame() ([]byte, error)
+	// WriteFrame sends a complete Ethernet frame. The transport must not
+	// keep frame after returning.
+	WriteFrame(frame []byte) error
+	Close() error
+}
+
+var ErrTransportClosed = errors.New("transport closed")
+
+// pipeEnd is one side of an in-memory Transport pair.
+type pipeEnd struct {
+	rx   <-chan []byte
+	tx   chan<- []byte
+	done chan struct{}
+	once *sync.Once
+}
+
+// NewPipe returns two connected in-memory transports. Frames written to one
+// end are read from the other, so an authenticator can be simulated without
+// a network card. Closing either end closes both.
+func NewPipe() (Transport, Transport) {
+	ab, ba := make(chan []byte, 64), make(chan []byte, 64)
+	done, once := make(chan struct{}), new(sync.Once)
+	a := &pipeEnd{rx: ba, tx: ab, done: done, once: once}
+	b := &pipeEnd{rx: ab, tx: ba, done: done, once: once}
+	return a, b
+}
+
+func (p *pipeEnd) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-p.rx:
+		return frame, nil
+	case <-p.done:
+		return nil, io.EOF
+	}
+}
+
+func (p *pipeEnd) WriteFrame(frame []byte) error {
+	buf := make([]byte, len(frame))
+	copy(buf, frame)
+	select {
+	case <-p.done:
+		return ErrTransportClosed
+	default:
+	}
+	select {
+	case p.tx <- buf:
+		return nil
+	case <-p.done:
+		return ErrTransportClosed
+	}
+}
+
+func (p *pipeEnd) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
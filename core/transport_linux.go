@@ -0,0 +1,133 @@
+//go:build linux
+
+package rjsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+type packetTransport struct {
+	file  *os.File
+	index int
+}
+
+// OpenPacketTransport binds an AF_PACKET socket for EAPOL frames to the named
+// interface. It needs CAP_NET_RAW but neither cgo nor libpcap. Ruijie
+// authenticators use MultiCastAddr rather than the PAE group address, so
+// both groups are joined.
+func OpenPacketTransport(name string) (Transport, error) {
+	return openPacketSocket(name, unix.ETH_P_PAE, nil, MultiCastAddr, paeGroupAddr)
+}
+
+// dhcpFilter is "udp dst port 68" compiled to classic BPF, it keeps the rest
+// of the IPv4 traffic out of the DHCP client's socket.
+var dhcpFilter = []unix.SockFilter{
+	{Code: 0x28, K: 12},            // ldh [12]
+	{Code: 0x15, Jf: 8, K: 0x0800}, // jeq #0x800
+	{Code: 0x30, K: 23},            // ldb [23]
+	{Code: 0x15, Jf: 6, K: 17},     // jeq #17
+	{Code: 0x28, K: 20},            // ldh [20]
+	{Code: 0x45, Jt: 4, K: 0x1fff}, // jset #0x1fff, drop fragments
+	{Code: 0xb1, K: 14},            // ldxb 4*([14]&0xf)
+	{Code: 0x48, K: 16},            // ldh [x+16]
+	{Code: 0x15, Jf: 1, K: 68},     // jeq #68
+	{Code: 0x06, K: 0x40000},       // ret #262144
+	{Code: 0x06, K: 0},             // ret #0
+}
+
+// openDHCPTransport binds an AF_PACKET socket receiving DHCP replies only.
+func openDHCPTransport(name string) (Transport, error) {
+	return openPacketSocket(name, unix.ETH_P_IP, dhcpFilter)
+}
+
+func openPacketSocket(name string, protocol uint16, filter []unix.SockFilter, groups ...net.HardwareAddr) (Transport, error) {
+	ifc, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	proto := htons(protocol)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if len(filter) > 0 {
+		prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+		if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog); err != nil {
+			unix.Close(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: proto, Ifindex: ifc.Index}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	for _, group := range groups {
+		if err := joinGroup(fd, ifc.Index, group); err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+	// A non-blocking descriptor is handed to the runtime poller, so Close
+	// interrupts a pending ReadFrame.
+	return &packetTransport{file: os.NewFile(uintptr(fd), "packet:"+name), index: ifc.Index}, nil
+}
+
+func joinGroup(fd, index int, group net.HardwareAddr) error {
+	mreq := unix.PacketMreq{Ifindex: int32(index), Type: unix.PACKET_MR_MULTICAST, Alen: uint16(len(group))}
+	copy(mreq.Address[:], group)
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+// JoinGroup makes the socket receive frames sent to group as well.
+func (t *packetTransport) JoinGroup(group net.HardwareAddr) error {
+	conn, err := t.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var jerr error
+	if err := conn.Control(func(fd uintptr) { jerr = joinGroup(int(fd), t.index, group) }); err != nil {
+		return err
+	}
+	return jerr
+}
+
+func (t *packetTransport) ReadFrame() ([]byte, error) {
+	buf := make([]byte, 2048)
+	n, err := t.file.Read(buf)
+	if err != nil {
+		if errors.Is(err, os.ErrClosed) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (t *packetTransport) WriteFrame(frame []byte) error {
+	_, err := t.file.Write(frame)
+	if errors.Is(err, os.ErrClosed) {
+		return ErrTransportClosed
+	}
+	return err
+}
+
+func (t *packetTransport) Close() error {
+	return t.file.Close()
+}
+
+// htons converts v to network byte order, which is a no-op on the big-endian
+// MIPS targets.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
@@ -0,0 +1,55 @@
+//go:build windows || pcap
+
+package rjsocks
+
+import (
+	"github.com/google/gopacket/pcap"
+)
+
+var DefaultSnaplen int32 = 1024
+
+type pcapTransport struct {
+	handle *pcap.Handle
+}
+
+// OpenPcapTransport captures on the named device through libpcap (WinPcap
+// on Windows).
+func OpenPcapTransport(name string) (Transport, error) {
+	handle, err := pcap.OpenLive(name, DefaultSnaplen, false, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	return &pcapTransport{handle: handle}, nil
+}
+
+// openPcapFilter opens the named device capturing only what expr matches.
+func openPcapFilter(name, expr string) (Transport, error) {
+	handle, err := pcap.OpenLive(name, DefaultSnaplen, false, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter(expr); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return &pcapTransport{handle: handle}, nil
+}
+
+func (t *pcapTransport) ReadFrame() ([]byte, error) {
+	for {
+		data, _, err := t.handle.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		return data, err
+	}
+}
+
+func (t *pcapTransport) WriteFrame(frame []byte) error {
+	return t.handle.WritePacketData(frame)
+}
+
+func (t *pcapTransport) Close() error {
+	t.handle.Close()
+	return nil
+}
@@ -5,11 +5,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"net"
-	"os/exec"
-	"syscall"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
 	"golang.org/x/text/encoding/simplifiedchinese"
 	"golang.org/x/text/transform"
 )
@@ -23,8 +19,15 @@ func GbkToUtf8(s []byte) ([]byte, error) {
 	return d, nil
 }
 
+// NetworkDev describes a capture device. Name is what the capture backend
+// opens, Description is what the user picks from.
+type NetworkDev struct {
+	Name        string
+	Description string
+}
+
 func ListNetworkDev() ([]string, error) {
-	interfaces, err := pcap.FindAllDevs()
+	interfaces, err := findAllDevs()
 	if err != nil {
 		return nil, err
 	}
@@ -47,13 +50,13 @@ func ListNetworkAdapter() ([]string, error) {
 	return ret, nil
 }
 
-func SelectNetworkDev(dev string) (*pcap.Interface, error) {
-	interfaces, err := pcap.FindAllDevs()
+func SelectNetworkDev(dev string) (*NetworkDev, error) {
+	interfaces, err := findAllDevs()
 	if err != nil {
 		return nil, err
 	}
 	for _, ifc := range interfaces {
-		if ifc.Description == dev {
+		if ifc.Description == dev || ifc.Name == dev {
 			return &ifc, nil
 		}
 	}
@@ -138,48 +141,6 @@ func checkSum(buf []byte) {
 	}
 }
 
-func reNewIP(adapter string) {
-	cmd := exec.Command("ipconfig", "/renew", adapter)
-	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
-	go cmd.Run()
-}
-
-var fillbuf = []byte{
-	// dhcp layer
-	0xff, 0xff, 0x37, 0x77, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
-	0xff, 0xff, 0xff, 0xff, 0xff, 0xfd, 0x36,
-	// padding layer
-	0x00, 0x00, 0x13, 0x11, 0x38, 0x30, 0x32, 0x31, 0x78, 0x2e, 0x65, 0x78, 0x65, 0x00, 0x00, 0x00,
-	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-	0x00, 0x00, 0x00, 0x00, 0x04, 0x0a, 0x00, 0x02, 0x00, 0x00, 0x00, 0x13, 0x11, 0x01, 0x8c, 0x1a,
-	0x28, 0x00, 0x00, 0x13, 0x11, 0x17, 0x22, 0x36, 0x38, 0x44, 0x43, 0x31, 0x32, 0x33, 0x42, 0x37,
-	0x45, 0x42, 0x32, 0x33, 0x39, 0x46, 0x32, 0x33, 0x41, 0x38, 0x43, 0x30, 0x30, 0x30, 0x33, 0x38,
-	0x38, 0x34, 0x39, 0x38, 0x36, 0x33, 0x39, 0x1a, 0x0c, 0x00, 0x00, 0x13, 0x11, 0x18, 0x06, 0x00,
-	0x00, 0x00, 0x00, 0x1a, 0x0e, 0x00, 0x00, 0x13, 0x11, 0x2d, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00,
-	0x00, 0x1a, 0x08, 0x00, 0x00, 0x13, 0x11, 0x2f, 0x02, 0x1a, 0x09, 0x00, 0x00, 0x13, 0x11, 0x35,
-	0x03, 0x01, 0x1a, 0x18, 0x00, 0x00, 0x13, 0x11, 0x36, 0x12, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1a, 0x18, 0x00, 0x00, 0x13, 0x11,
-	0x38, 0x12, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xfe, 0x86,
-	0x13, 0x4c, 0x1a, 0x88, 0x00, 0x00, 0x13, 0x11, 0x4d, 0x82, 0x36, 0x38, 0x64, 0x63, 0x31, 0x32,
-	0x33, 0x62, 0x30, 0x37, 0x65, 0x62, 0x32, 0x33, 0x39, 0x66, 0x32, 0x33, 0x61, 0x38, 0x30, 0x64,
-	0x63, 0x66, 0x32, 0x35, 0x38, 0x37, 0x35, 0x64, 0x30, 0x35, 0x37, 0x37, 0x30, 0x63, 0x37, 0x32,
-	0x31, 0x65, 0x34, 0x35, 0x36, 0x34, 0x35, 0x65, 0x35, 0x33, 0x37, 0x61, 0x62, 0x33, 0x35, 0x31,
-	0x62, 0x62, 0x36, 0x33, 0x31, 0x35, 0x35, 0x61, 0x65, 0x31, 0x36, 0x32, 0x36, 0x31, 0x36, 0x37,
-	0x65, 0x62, 0x30, 0x39, 0x32, 0x32, 0x33, 0x65, 0x32, 0x61, 0x30, 0x61, 0x37, 0x38, 0x30, 0x33,
-	0x31, 0x31, 0x36, 0x31, 0x61, 0x63, 0x30, 0x39, 0x64, 0x61, 0x32, 0x64, 0x63, 0x30, 0x37, 0x33,
-	0x36, 0x39, 0x33, 0x61, 0x34, 0x66, 0x35, 0x61, 0x32, 0x39, 0x32, 0x38, 0x36, 0x37, 0x35, 0x31,
-	0x66, 0x39, 0x37, 0x66, 0x34, 0x64, 0x30, 0x34, 0x36, 0x38, 0x1a, 0x28, 0x00, 0x00, 0x13, 0x11,
-	0x39, 0x22, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-	0x00, 0x00, 0x1a, 0x48, 0x00, 0x00, 0x13, 0x11, 0x54, 0x42, 0x48, 0x55, 0x53, 0x54, 0x4d, 0x4f,
-	0x4f, 0x4e, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1a, 0x08, 0x00, 0x00, 0x13, 0x11,
-	0x55, 0x02, 0x1a, 0x09, 0x00, 0x00, 0x13, 0x11, 0x62, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-}
-
-var fillLayer = gopacket.Payload(fillbuf)
 /*
 type RawLayer struct {
 	RawBytes []byte
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/astaxie/beego/config"
 	"github.com/lxn/walk"
+	rjsocks "github.com/tr3ee/go-rjsocks/core"
 )
 
 var appConfig *AppConfig
@@ -21,10 +25,40 @@ func init() {
 	appConfig.ReadIn()
 }
 
+// credentialFile and keyFile hold the remembered password where the OS
+// offers no keyring. profileFile is the optional TOML config of named
+// profiles shared with the command line client.
+const (
+	credentialFile = "credentials.dat"
+	keyFile        = "rjsocks.key"
+	profileFile    = "rjsocks.toml"
+)
+
 type AppConfig struct {
 	configer                            config.Configer
+	store                               rjsocks.CredentialStore
+	storedUser                          string
 	Username, Password, Device, Adapter string
+	Renew                               string
 	Remember, AutoLogin                 bool
+	// Profile names the active profile of profiles, empty uses the
+	// settings of config.ini only.
+	Profile  string
+	profiles *rjsocks.Config
+}
+
+// openCredentialStore prefers the OS keyring and falls back to a file
+// encrypted with a key kept next to it.
+func openCredentialStore() rjsocks.CredentialStore {
+	if k := rjsocks.NewKeyringStore("RJSocks"); k.Available() {
+		return k
+	}
+	store, err := rjsocks.NewKeyFileStore(credentialFile, keyFile)
+	if err != nil {
+		log.Printf("无法打开密码存储: %v\n", err)
+		return nil
+	}
+	return store
 }
 
 func (c *AppConfig) ReadIn() {
@@ -34,19 +68,190 @@ func (c *AppConfig) ReadIn() {
 		log.Fatal(err)
 	}
 	c.Username = c.configer.DefaultString("username", "")
-	c.Password = c.configer.DefaultString("password", "")
 	c.Device = c.configer.DefaultString("device", "")
 	c.Adapter = c.configer.DefaultString("adapter", "")
+	c.Renew = c.configer.DefaultString("renew", rjsocks.RenewAuto)
 	c.Remember = c.configer.DefaultBool("Remember", true)
 	c.AutoLogin = c.configer.DefaultBool("AutoLogin", false)
+	c.store = openCredentialStore()
+	if legacy := c.configer.DefaultString("password", ""); len(legacy) > 0 {
+		c.Password = legacy
+		c.migratePassword(legacy)
+	} else {
+		c.Password = c.rememberedPassword(c.Username)
+	}
+	c.storedUser = c.Username
+	c.loadProfiles(c.configer.DefaultString("profile", ""))
+}
+
+// rememberedPassword returns the stored password of user, if any.
+func (c *AppConfig) rememberedPassword(user string) string {
+	if c.store == nil || !c.Remember || len(user) == 0 {
+		return ""
+	}
+	pass, err := c.store.Get(user)
+	if err != nil && err != rjsocks.ErrCredentialNotFound {
+		log.Printf("无法读取保存的密码: %v\n", err)
+	}
+	return pass
+}
+
+// loadProfiles reads profileFile if there is one and selects the profile
+// called name, or the default profile of the file.
+func (c *AppConfig) loadProfiles(name string) {
+	profiles, err := rjsocks.LoadConfig(profileFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("无法读取%s: %v\n", profileFile, err)
+		walk.MsgBox(nil, "错误", "配置文件"+profileFile+"有误，将只使用config.ini中的设置：\n"+err.Error(), walk.MsgBoxIconError)
+		return
+	}
+	c.profiles = profiles
+	if p, err := profiles.Profile(name); err == nil {
+		c.SelectProfile(p.Name)
+	} else if len(name) > 0 {
+		log.Printf("无法选择配置方案: %v\n", err)
+	}
+}
+
+// ProfileNames returns the names of the profiles in profileFile.
+func (c *AppConfig) ProfileNames() []string {
+	if c.profiles == nil {
+		return nil
+	}
+	return c.profiles.Names()
+}
+
+// SelectProfile makes the profile called name active and shows its account
+// and interface in the login window, an empty name goes back to config.ini.
+func (c *AppConfig) SelectProfile(name string) {
+	c.Profile = ""
+	if len(name) == 0 || c.profiles == nil {
+		return
+	}
+	p := c.profiles.Profiles[name]
+	if p == nil {
+		return
+	}
+	c.Profile = name
+	if p.User != c.Username {
+		// switching accounts keeps the password of the previous one
+		c.Password = c.rememberedPassword(p.User)
+		c.storedUser = p.User
+	}
+	c.Username, c.Device, c.Adapter = p.User, p.Interface, p.Adapter
+}
+
+// NeedsPassword reports whether the password has to be typed in the login
+// window, the active profile may name its own source.
+func (c *AppConfig) NeedsPassword() bool {
+	if len(c.Profile) > 0 && c.profiles != nil {
+		p := c.profiles.Profiles[c.Profile]
+		if len(p.Password) > 0 || len(p.PasswordFrom) > 0 {
+			return false
+		}
+	}
+	return len(c.Password) == 0
+}
+
+// NewService builds the service of the active profile, or of the settings
+// in config.ini when there is none. The account and interface come from
+// the login window, the password from the profile if it names one.
+func (c *AppConfig) NewService() (*rjsocks.Service, error) {
+	if len(c.Profile) == 0 || c.profiles == nil {
+		s, err := rjsocks.NewService(c.Username, c.Password, c.Device, c.Adapter)
+		if err != nil {
+			return nil, err
+		}
+		renewer, err := rjsocks.NewRenewer(c.Renew)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.SetRenewer(renewer)
+		return s, nil
+	}
+	p := *c.profiles.Profiles[c.Profile]
+	p.User, p.Interface, p.Adapter = c.Username, c.Device, c.Adapter
+	var src rjsocks.PasswordSource
+	if len(p.Password) == 0 && len(p.PasswordFrom) == 0 {
+		src = rjsocks.StaticPassword(c.Password)
+	}
+	return p.NewService(src)
+}
+
+// migratePassword moves a password written in cleartext by older versions
+// into the credential store. The cleartext is dropped from config.ini even
+// if the store fails, the password then has to be typed in again next time.
+func (c *AppConfig) migratePassword(pass string) {
+	switch {
+	case c.store == nil:
+		warnPassword("没有可用的密码存储，config.ini中的明文密码已删除，下次启动时需要重新输入密码")
+	case len(c.Username) == 0:
+	default:
+		if err := c.store.Set(c.Username, pass); err != nil {
+			log.Printf("无法迁移config.ini中的明文密码: %v\n", err)
+			warnPassword("无法保存密码，config.ini中的明文密码已删除，下次启动时需要重新输入密码")
+		} else {
+			log.Printf("已将config.ini中的明文密码迁移到加密存储\n")
+		}
+	}
+	c.dropIniPassword()
+}
+
+// dropIniPassword removes the cleartext password from config.ini and
+// reloads it, so that WriteBack cannot write it back.
+func (c *AppConfig) dropIniPassword() {
+	if err := removeIniKey("config.ini", "password"); err != nil {
+		log.Printf("无法从config.ini中删除明文密码: %v\n", err)
+		walk.MsgBox(nil, "错误", "无法从config.ini中删除明文密码，请手动删除password一行", walk.MsgBoxIconError)
+		return
+	}
+	configer, err := config.NewConfig("ini", "config.ini")
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.configer = configer
+}
+
+func warnPassword(msg string) {
+	log.Println(msg)
+	walk.MsgBox(nil, "警告", msg, walk.MsgBoxIconWarning)
+}
+
+// removeIniKey drops every line setting key from the ini file at path,
+// beego cannot delete keys itself.
+func removeIniKey(path, key string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		if k, _, ok := strings.Cut(line, "="); ok && strings.EqualFold(strings.TrimSpace(k), key) {
+			continue
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out.Bytes(), 0666)
 }
 
 func (c *AppConfig) WriteBack() {
 	c.configer.Set("username", c.Username)
 	c.configer.Set("device", c.Device)
 	c.configer.Set("adapter", c.Adapter)
+	c.configer.Set("renew", c.Renew)
+	c.configer.Set("profile", c.Profile)
+	c.savePassword()
 	if c.Remember {
-		c.configer.Set("password", c.Password)
 		c.configer.Set("remember", "true")
 		if c.AutoLogin {
 			c.configer.Set("autologin", "true")
@@ -54,9 +259,32 @@ func (c *AppConfig) WriteBack() {
 			c.configer.Set("autologin", "false")
 		}
 	} else {
-		c.configer.Set("password", "")
 		c.configer.Set("remember", "false")
 		c.configer.Set("autologin", "false")
 	}
 	c.configer.SaveConfigFile("config.ini")
 }
+
+// savePassword remembers or forgets the password in the credential store,
+// never in config.ini.
+func (c *AppConfig) savePassword() {
+	if c.store == nil {
+		if c.Remember && len(c.Password) > 0 {
+			warnPassword("没有可用的密码存储，无法记住密码")
+		}
+		return
+	}
+	if len(c.storedUser) > 0 && c.storedUser != c.Username {
+		c.store.Delete(c.storedUser)
+	}
+	var err error
+	if c.Remember && len(c.Username) > 0 {
+		err = c.store.Set(c.Username, c.Password)
+	} else if len(c.Username) > 0 {
+		err = c.store.Delete(c.Username)
+	}
+	if err != nil {
+		log.Printf("无法保存密码: %v\n", err)
+	}
+	c.storedUser = c.Username
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/exec"
@@ -67,30 +68,41 @@ func main() {
 	mainWnd.Run()
 }
 
-func getServiceStat() rjsocks.SrvStat {
+func subscribeService() (<-chan rjsocks.StateEvent, func()) {
 	srvRWMutex.RLock()
 	defer srvRWMutex.RUnlock()
-	return service.State
+	return service.Subscribe()
 }
 
 func updateSrvStat() {
 	sOnce := sync.Once{}
 	fOnce := sync.Once{}
 	for {
-		time.Sleep(1 * time.Second)
-		currState := getServiceStat()
-		if err := nIcon.SetToolTip(service.State.String()); err != nil {
-			break
-		}
-		if currState == rjsocks.SrvStatSuccess {
-			nIcon.SetIcon(iconSuccess)
-			sOnce.Do(func() {
-				nIcon.ShowMessage("RJSocks认证成功", "  GITHUB地址 ⭐⭐⭐\nhttps://github.com/tr3ee/go-rjsocks")
-			})
-		} else if currState == rjsocks.SrvStatFailure {
-			nIcon.SetIcon(iconFailure)
-			fOnce.Do(func() { nIcon.ShowError("RJSocks认证失败", "当前设备未联网") })
+		// the subscription ends whenever allocService replaces the service
+		events, cancel := subscribeService()
+		for ev := range events {
+			if err := nIcon.SetToolTip(ev.To.String()); err != nil {
+				cancel()
+				return
+			}
+			if ev.To.Online() {
+				nIcon.SetIcon(iconSuccess)
+				sOnce.Do(func() {
+					nIcon.ShowMessage("RJSocks认证成功", "  GITHUB地址 ⭐⭐⭐\nhttps://github.com/tr3ee/go-rjsocks")
+				})
+			} else if ev.To == rjsocks.SrvStatHeld || ev.To == rjsocks.SrvStatError {
+				nIcon.SetIcon(iconFailure)
+				fOnce.Do(func() {
+					msg := "当前设备未联网"
+					if ev.Err != nil {
+						msg = ev.Err.Error()
+					}
+					nIcon.ShowError("RJSocks认证失败", msg)
+				})
+			}
 		}
+		cancel()
+		time.Sleep(1 * time.Second)
 	}
 }
 
@@ -102,11 +114,11 @@ func allocService() {
 	if service != nil {
 		service.Close()
 	}
-	service, err = rjsocks.NewService(appConfig.Username, appConfig.Password, appConfig.Device, appConfig.Adapter)
+	service, err = appConfig.NewService()
 	if err != nil {
 		panic(err)
 	}
-	go service.Run()
+	go service.Run(context.Background())
 }
 
 func runLoginFragment() bool {
@@ -141,6 +153,33 @@ func setNotifyIcon() {
 	})
 	nIcon.ContextMenu().Actions().Add(confAction)
 
+	if names := appConfig.ProfileNames(); len(names) > 0 {
+		profileMenu, _ := walk.NewMenu()
+		var actions []*walk.Action
+		for _, name := range append([]string{""}, names...) {
+			name := name
+			text := name
+			if len(text) == 0 {
+				text = "不使用配置方案"
+			}
+			action := NewCheckableAction(text, name == appConfig.Profile)
+			action.Triggered().Attach(func() {
+				for _, a := range actions {
+					a.SetChecked(a == action)
+				}
+				appConfig.SelectProfile(name)
+				if appConfig.NeedsPassword() && !runLoginFragment() {
+					return
+				}
+				allocService()
+			})
+			profileMenu.Actions().Add(action)
+			actions = append(actions, action)
+		}
+		profileMenuAction, _ := nIcon.ContextMenu().Actions().AddMenu(profileMenu)
+		profileMenuAction.SetText("配置方案(&P)")
+	}
+
 	loginAction := NewAction("断开连接(&O)")
 	loginAction.Triggered().Attach(func() {
 		if !runLoginFragment() {
@@ -154,8 +193,14 @@ func setNotifyIcon() {
 	renewAction := NewAction("刷新IP地址(&R)")
 	renewAction.Triggered().Attach(func() {
 		log.Println("刷新IP地址...")
-		ExecBackground("ipconfig", "/renew", appConfig.Adapter)
 		nIcon.ShowMessage("RJSocks 通知", "正在刷新IP地址...")
+		go func() {
+			if err := service.RenewIP(context.Background()); err != nil {
+				nIcon.ShowError("刷新IP地址失败", err.Error())
+			} else {
+				nIcon.ShowMessage("RJSocks 通知", "IP地址刷新完成")
+			}
+		}()
 	})
 	nIcon.ContextMenu().Actions().Add(renewAction)
 